@@ -0,0 +1,132 @@
+// Package applog provides the structured logs of the subsystems of the proxy,
+// each with its own level.
+package applog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	mu           sync.Mutex
+	base         slog.Handler = newHandler(os.Stderr, "text")
+	defaultLevel slog.Level
+	levels       = map[string]*slog.LevelVar{}
+)
+
+// Setup sets the format of the logs, "text" or "json", and the levels from a
+// spec like "info,filter=debug,mitm=warn", where the bare level applies to
+// the subsystems without one. The standard logger goes through the "main"
+// subsystem afterwards.
+func Setup(w io.Writer, format, spec string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	def, explicit, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	base = newHandler(w, format)
+	defaultLevel = def
+	for name, l := range explicit {
+		if levels[name] == nil {
+			levels[name] = new(slog.LevelVar)
+		}
+		levels[name].Set(l)
+	}
+	for name, v := range levels {
+		if _, ok := explicit[name]; !ok {
+			v.Set(def)
+		}
+	}
+	mu.Unlock()
+	slog.SetDefault(For("main"))
+	return nil
+}
+
+// For returns the logger of the subsystem. It can be called before Setup.
+func For(subsystem string) *slog.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	v := levels[subsystem]
+	if v == nil {
+		v = new(slog.LevelVar)
+		v.Set(defaultLevel)
+		levels[subsystem] = v
+	}
+	h := &handler{level: v, with: func(h slog.Handler) slog.Handler { return h }}
+	return slog.New(h).With("subsystem", subsystem)
+}
+
+// Fatal logs the error and exits.
+func Fatal(l *slog.Logger, msg string, args ...any) {
+	l.Error(msg, args...)
+	os.Exit(1)
+}
+
+func parseLevels(spec string) (def slog.Level, explicit map[string]slog.Level, err error) {
+	explicit = map[string]slog.Level{}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, level, found := strings.Cut(s, "=")
+		if !found {
+			name, level = "", s
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return def, nil, fmt.Errorf("invalid log level %q: %w", s, err)
+		}
+		if name == "" {
+			def = l
+		} else {
+			explicit[name] = l
+		}
+	}
+	return def, explicit, nil
+}
+
+func newHandler(w io.Writer, format string) slog.Handler {
+	// levels are checked per subsystem
+	opts := &slog.HandlerOptions{Level: slog.Level(-100)}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// handler checks the level of its subsystem and hands the records over to
+// the handler in place at the time they are logged, so loggers created
+// before Setup follow it.
+type handler struct {
+	level *slog.LevelVar
+	// replays the attributes and groups added to the logger on the base
+	with func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	mu.Lock()
+	b := base
+	mu.Unlock()
+	return h.with(b).Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{h.level, func(b slog.Handler) slog.Handler { return h.with(b).WithAttrs(attrs) }}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{h.level, func(b slog.Handler) slog.Handler { return h.with(b).WithGroup(name) }}
+}
@@ -0,0 +1,49 @@
+package applog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	// loggers created before Setup follow it
+	filter := For("filter")
+	var buf bytes.Buffer
+	if err := Setup(&buf, "json", "warn,filter=debug"); err != nil {
+		t.Fatal(err)
+	}
+	api := For("api")
+
+	filter.Debug("walking", "request", "r1")
+	api.Info("dropped")
+	api.With("request", "r2").Warn("failed")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["subsystem"] != "filter" || m["msg"] != "walking" || m["request"] != "r1" || m["level"] != "DEBUG" {
+		t.Errorf("Unexpected record %v", m)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["subsystem"] != "api" || m["request"] != "r2" {
+		t.Errorf("Unexpected record %v", m)
+	}
+
+	for _, spec := range []string{"loud", "filter=loud"} {
+		if err := Setup(&buf, "text", spec); err == nil {
+			t.Errorf("Expected an error for %s", spec)
+		}
+	}
+	if err := Setup(&buf, "xml", "info"); err == nil {
+		t.Errorf("Expected an error for the xml format")
+	}
+}
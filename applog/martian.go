@@ -0,0 +1,32 @@
+package applog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// MartianLogger adapts a logger to the logs of the martian library.
+type MartianLogger struct {
+	l *slog.Logger
+}
+
+func NewMartianLogger(l *slog.Logger) *MartianLogger {
+	return &MartianLogger{l}
+}
+
+// Infof logs at the debug level, martian being chatty at the info level.
+func (m *MartianLogger) Infof(format string, args ...interface{}) {
+	m.Debugf(format, args...)
+}
+
+func (m *MartianLogger) Debugf(format string, args ...interface{}) {
+	if !m.l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	m.l.Debug(fmt.Sprintf(format, args...))
+}
+
+func (m *MartianLogger) Errorf(format string, args ...interface{}) {
+	m.l.Error(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,317 @@
+// Package ca manages the certificate authority signing the MITM certificates,
+// kept in a data directory so devices only trust it once.
+package ca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	certFile     = "ca.pem"
+	keyFile      = "ca-key.pem"
+	nextCertFile = "ca-next.pem"
+	nextKeyFile  = "ca-next-key.pem"
+	// holds the time the next authority takes over
+	activateFile = "ca-next.activate"
+	// names the directory of the current authority once a rotation has
+	// completed, the files above are the current one until then
+	currentFile = "ca.current"
+
+	DefaultValidity = 10 * 365 * 24 * time.Hour
+)
+
+// Authority is a CA certificate with its private key.
+type Authority struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Store keeps the current authority, and during a rotation the next one,
+// in a directory.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{dir}
+}
+
+// Generate creates a self signed CA.
+func Generate(name, organization string, validity time.Duration) (*Authority, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha1.Sum(pub)
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{organization},
+		},
+		SubjectKeyId:          keyID[:],
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// tolerate clocks of devices running a bit late
+		NotBefore: now.Add(-24 * time.Hour),
+		NotAfter:  now.Add(validity),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{cert, key}, nil
+}
+
+// LoadOrGenerate returns the current authority, generating it on first run.
+// A pending rotation whose overlap is over is completed first, which is only
+// done at startup, before the authority is used to sign.
+func (s *Store) LoadOrGenerate(name, organization string) (a *Authority, created bool, err error) {
+	if at, err := s.activation(); err == nil && !time.Now().Before(at) {
+		if err := s.promote(); err != nil {
+			return nil, false, err
+		}
+	}
+	a, err = s.Load()
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return a, false, err
+	}
+	if a, err = Generate(name, organization, DefaultValidity); err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, false, err
+	}
+	return a, true, s.write(a, certFile, keyFile)
+}
+
+// Load returns the current authority.
+func (s *Store) Load() (*Authority, error) {
+	cert, key, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return s.read(cert, key)
+}
+
+// current returns the files of the current authority.
+func (s *Store) current() (cert, key string, err error) {
+	b, err := os.ReadFile(s.path(currentFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return certFile, keyFile, nil
+	} else if err != nil {
+		return "", "", err
+	}
+	name := strings.TrimSpace(string(b))
+	return filepath.Join(name, certFile), filepath.Join(name, keyFile), nil
+}
+
+// Next returns the authority taking over at the returned time, or nil if no
+// rotation is in progress.
+func (s *Store) Next() (*Authority, time.Time, error) {
+	at, err := s.activation()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, at, nil
+	} else if err != nil {
+		return nil, at, err
+	}
+	a, err := s.read(nextCertFile, nextKeyFile)
+	return a, at, err
+}
+
+// Trusted returns the certificates devices should trust: the current one
+// and the next one during a rotation.
+func (s *Store) Trusted() ([]*x509.Certificate, error) {
+	a, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	certs := []*x509.Certificate{a.Cert}
+	next, _, err := s.Next()
+	if err != nil {
+		return nil, err
+	}
+	if next != nil {
+		certs = append(certs, next.Cert)
+	}
+	return certs, nil
+}
+
+// Rotate generates the next authority, which replaces the current one after
+// the overlap, leaving time for the devices to trust it.
+func (s *Store) Rotate(overlap time.Duration) (*Authority, time.Time, error) {
+	cur, err := s.Load()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	org := ""
+	if len(cur.Cert.Subject.Organization) > 0 {
+		org = cur.Cert.Subject.Organization[0]
+	}
+	next, err := Generate(cur.Cert.Subject.CommonName, org, DefaultValidity)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := s.write(next, nextCertFile, nextKeyFile); err != nil {
+		return nil, time.Time{}, err
+	}
+	at := time.Now().Add(overlap)
+	return next, at, os.WriteFile(s.path(activateFile), []byte(at.Format(time.RFC3339)), 0600)
+}
+
+// promote makes the next authority the current one. It's written to a
+// temporary directory renamed once complete, then named by the current file,
+// replaced by a rename too, so the swap is atomic. Promoting again after a
+// crash completes it.
+func (s *Store) promote() error {
+	next, err := s.read(nextCertFile, nextKeyFile)
+	if err != nil {
+		return err
+	}
+	prev, _, err := s.current()
+	if err != nil {
+		return err
+	}
+	name := "ca-" + next.Cert.SerialNumber.Text(16)
+	if _, err := os.Stat(s.path(name)); errors.Is(err, os.ErrNotExist) {
+		tmp, err := os.MkdirTemp(s.dir, ".ca-promote-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		rel := filepath.Base(tmp)
+		if err := s.write(next, filepath.Join(rel, certFile), filepath.Join(rel, keyFile)); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, s.path(name)); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	tmp := s.path(currentFile + ".tmp")
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path(currentFile)); err != nil {
+		return err
+	}
+	// the rotation is over, the next and previous authorities are unused
+	os.Remove(s.path(activateFile))
+	os.Remove(s.path(nextKeyFile))
+	os.Remove(s.path(nextCertFile))
+	if dir := filepath.Dir(prev); dir == "." {
+		os.Remove(s.path(keyFile))
+		os.Remove(s.path(certFile))
+	} else if dir != name {
+		os.RemoveAll(s.path(dir))
+	}
+	return nil
+}
+
+func (s *Store) activation() (time.Time, error) {
+	b, err := os.ReadFile(s.path(activateFile))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *Store) read(cert, key string) (*Authority, error) {
+	cb, err := os.ReadFile(s.path(cert))
+	if err != nil {
+		return nil, err
+	}
+	kb, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(cb, kb)
+}
+
+// Parse reads a PEM encoded certificate and private key.
+func Parse(certPEM, keyPEM []byte) (*Authority, error) {
+	cb, _ := pem.Decode(certPEM)
+	if cb == nil || cb.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	kb, _ := pem.Decode(keyPEM)
+	if kb == nil {
+		return nil, errors.New("no private key found")
+	}
+	var key any
+	switch kb.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(kb.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(kb.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(kb.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return &Authority{cert, signer}, nil
+}
+
+func (s *Store) write(a *Authority, cert, key string) error {
+	kb, err := x509.MarshalPKCS8PrivateKey(a.Key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path(key), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(cert), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.Cert.Raw}), 0644)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate as colon
+// separated hex, the way browsers and devices show it.
+func Fingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
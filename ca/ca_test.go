@@ -0,0 +1,111 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(t.TempDir())
+	a, created, err := s.LoadOrGenerate("Test CA", "Clarity")
+	if err != nil || !created {
+		t.Fatalf("Expected a new CA, got %t %v", created, err)
+	}
+	again, created, err := s.LoadOrGenerate("Test CA", "Clarity")
+	if err != nil || created || !again.Cert.Equal(a.Cert) {
+		t.Fatalf("Expected the CA to be reused, got %t %v", created, err)
+	}
+
+	next, _, err := s.Rotate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := s.Trusted()
+	if err != nil || len(certs) != 2 || !certs[0].Equal(a.Cert) || !certs[1].Equal(next.Cert) {
+		t.Fatalf("Both CAs must be trusted during the overlap, got %d %v", len(certs), err)
+	}
+
+	next, _, err = s.Rotate(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the exports don't change the CA the running proxy signs with
+	if cur, err := s.Load(); err != nil || !cur.Cert.Equal(a.Cert) {
+		t.Fatalf("The CA must only change at startup: %v", err)
+	}
+	if certs, err := s.Trusted(); err != nil || len(certs) != 2 {
+		t.Fatalf("Both CAs must be trusted until the restart, got %d %v", len(certs), err)
+	}
+	for _, want := range []*Authority{next, nil} {
+		if want == nil {
+			// a second rotation replaces the promoted CA
+			if want, _, err = s.Rotate(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cur, _, err := s.LoadOrGenerate("Test CA", "Clarity")
+		if err != nil || !cur.Cert.Equal(want.Cert) {
+			t.Fatalf("The next CA must take over after the overlap: %v", err)
+		}
+		if n, _, err := s.Next(); n != nil || err != nil {
+			t.Errorf("The rotation must be over, got %v %v", n, err)
+		}
+	}
+	files, _ := os.ReadDir(s.dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 2 || names[1] != currentFile {
+		t.Errorf("Expected the current CA and its directory only, got %v", names)
+	}
+}
+
+func TestExport(t *testing.T) {
+	a, err := Generate("Test CA", "Clarity", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Generate("Next CA", "Clarity", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := []*x509.Certificate{a.Cert, b.Cert}
+
+	var buf bytes.Buffer
+	if err := Export(&buf, certs, FormatPEM); err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(buf.Bytes())
+	if block == nil || !bytes.Equal(block.Bytes, a.Cert.Raw) {
+		t.Fatalf("Expected the first certificate in PEM")
+	}
+	if block, _ = pem.Decode(rest); block == nil || !bytes.Equal(block.Bytes, b.Cert.Raw) {
+		t.Fatalf("Expected the second certificate in PEM")
+	}
+
+	buf.Reset()
+	Export(&buf, certs, FormatDER)
+	if !bytes.Equal(buf.Bytes(), a.Cert.Raw) {
+		t.Errorf("Expected the first certificate in DER")
+	}
+
+	buf.Reset()
+	if err := Export(&buf, certs, FormatMobileConfig); err != nil {
+		t.Fatal(err)
+	}
+	profile := buf.String()
+	if strings.Count(profile, "com.apple.security.root") != 2 || !strings.Contains(profile, base64.StdEncoding.EncodeToString(b.Cert.Raw)) {
+		t.Errorf("Unexpected profile: %s", profile)
+	}
+
+	if err := Export(&buf, certs, "p12"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,350 @@
+package ca
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"shawnma.com/clarity/metrics"
+	"shawnma.com/clarity/util"
+)
+
+var (
+	cacheRequests = metrics.NewCounterVec("clarity_mitm_cert_cache_requests_total",
+		"Leaf certificate lookups by result, hit, miss or expired.", "result")
+	cacheEvictions = metrics.NewCounterVec("clarity_mitm_cert_cache_evictions_total",
+		"Leaf certificates evicted from the cache.")
+	cacheRenewals = metrics.NewCounterVec("clarity_mitm_cert_cache_renewals_total",
+		"Leaf certificates renewed ahead of their expiry.")
+	cacheSize = metrics.NewGaugeVec("clarity_mitm_cert_cache_size",
+		"Leaf certificates in the cache.")
+)
+
+// CertCache issues the leaf certificates of the intercepted hosts. The most
+// recently used ones are kept in memory and, encrypted with a key derived
+// from the CA key, on disk so they survive restarts. Certificates are renewed
+// in the background once in the last quarter of their validity.
+type CertCache struct {
+	ca       *Authority
+	dir      string
+	size     int
+	validity time.Duration
+	aead     cipher.AEAD
+
+	mu sync.Mutex
+	// of *leaf, the most recently used first
+	lru      *list.List
+	entries  map[string]*list.Element
+	renewing util.Set[string]
+	// by host, the issues in progress
+	issuing map[string]*pending
+}
+
+// pending is an issue in progress, which the concurrent lookups of its host
+// wait for rather than issuing again.
+type pending struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+type leaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewCertCache loads the certificates kept in dir, issued by a, and keeps up
+// to size of them.
+func NewCertCache(a *Authority, dir string, size int, validity time.Duration) (*CertCache, error) {
+	kb, err := x509.MarshalPKCS8PrivateKey(a.Key)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(append([]byte("clarity leaf cache\x00"), kb...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &CertCache{
+		ca:       a,
+		dir:      dir,
+		size:     size,
+		validity: validity,
+		aead:     aead,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		renewing: util.Set[string]{},
+		issuing:  map[string]*pending{},
+	}
+	c.load()
+	return c, nil
+}
+
+// TLS returns a config issuing certificates for the SNI of the clients.
+func (c *CertCache) TLS() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" {
+				return nil, errors.New("SNI not provided, failed to build certificate")
+			}
+			return c.Get(hello.ServerName)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+// TLSForHost is like TLS, falling back to host when the client sends no SNI.
+func (c *CertCache) TLSForHost(host string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return c.Get(hello.ServerName)
+			}
+			return c.Get(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+// Get returns the certificate of the host, issuing it if needed.
+func (c *CertCache) Get(host string) (*tls.Certificate, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	now := time.Now()
+
+	c.mu.Lock()
+	e := c.entries[host]
+	if e != nil {
+		c.lru.MoveToFront(e)
+		cert := e.Value.(*leaf).cert
+		renew := now.After(cert.Leaf.NotAfter.Add(-c.validity/4)) && !c.renewing.Has(host)
+		if renew {
+			c.renewing.Add(host)
+		}
+		c.mu.Unlock()
+		if now.Before(cert.Leaf.NotAfter) {
+			cacheRequests.Inc("hit")
+			if renew {
+				go c.renew(host)
+			}
+			return cert, nil
+		}
+		cacheRequests.Inc("expired")
+	} else {
+		c.mu.Unlock()
+		cacheRequests.Inc("miss")
+	}
+
+	return c.issueOnce(host)
+}
+
+// issueOnce issues and caches the certificate of the host, unless an issue
+// is already in progress, whose outcome is returned instead.
+func (c *CertCache) issueOnce(host string) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if p := c.issuing[host]; p != nil {
+		c.mu.Unlock()
+		<-p.done
+		return p.cert, p.err
+	}
+	p := &pending{done: make(chan struct{})}
+	c.issuing[host] = p
+	c.mu.Unlock()
+
+	p.cert, p.err = c.issue(host)
+	if p.err == nil {
+		c.put(host, p.cert)
+	}
+	c.mu.Lock()
+	delete(c.issuing, host)
+	c.mu.Unlock()
+	close(p.done)
+	return p.cert, p.err
+}
+
+func (c *CertCache) renew(host string) {
+	defer func() {
+		c.mu.Lock()
+		c.renewing.Remove(host)
+		c.mu.Unlock()
+	}()
+	if _, err := c.issueOnce(host); err == nil {
+		cacheRenewals.Inc()
+	}
+}
+
+func (c *CertCache) put(host string, cert *tls.Certificate) {
+	// the cache works without the disk, it's only lost on restart
+	c.save(host, cert)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[host]; e != nil {
+		e.Value.(*leaf).cert = cert
+		c.lru.MoveToFront(e)
+	} else {
+		c.entries[host] = c.lru.PushFront(&leaf{host, cert})
+	}
+	for c.lru.Len() > c.size {
+		old := c.lru.Remove(c.lru.Back()).(*leaf)
+		delete(c.entries, old.host)
+		os.Remove(c.path(old.host))
+		cacheEvictions.Inc()
+	}
+	cacheSize.Set(float64(c.lru.Len()))
+}
+
+func (c *CertCache) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: c.ca.Cert.Subject.Organization},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(c.validity),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca.Cert, key.Public(), c.ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	x509c, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{raw, c.ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        x509c,
+	}, nil
+}
+
+// path names the file of the host without revealing it.
+func (c *CertCache) path(host string) string {
+	sum := sha256.Sum256([]byte(host))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16])+".crt")
+}
+
+func (c *CertCache) save(host string, cert *tls.Certificate) error {
+	kb, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	plain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	plain = append(plain, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb})...)
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	tmp := c.path(host) + ".tmp"
+	if err := os.WriteFile(tmp, c.aead.Seal(nonce, nonce, plain, nil), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path(host))
+}
+
+// load reads the most recent certificates from the disk, dropping the ones
+// which are unreadable, for example after the CA changed, or expired.
+func (c *CertCache) load() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type file struct {
+		name string
+		mod  time.Time
+	}
+	var files []file
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			files = append(files, file{e.Name(), info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.After(files[j].mod) })
+	for _, f := range files {
+		p := filepath.Join(c.dir, f.name)
+		cert, host, err := c.read(p)
+		if err != nil || len(c.entries) >= c.size || time.Now().After(cert.Leaf.NotAfter) || c.path(host) != p {
+			os.Remove(p)
+			continue
+		}
+		c.entries[host] = c.lru.PushBack(&leaf{host, cert})
+	}
+	cacheSize.Set(float64(c.lru.Len()))
+}
+
+func (c *CertCache) read(path string) (*tls.Certificate, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	n := c.aead.NonceSize()
+	if len(b) < n {
+		return nil, "", errors.New("truncated certificate file")
+	}
+	plain, err := c.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	cb, rest := pem.Decode(plain)
+	if cb == nil {
+		return nil, "", errors.New("no certificate found")
+	}
+	kb, _ := pem.Decode(rest)
+	if kb == nil {
+		return nil, "", errors.New("no private key found")
+	}
+	x509c, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(kb.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{cb.Bytes, c.ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        x509c,
+	}, x509c.Subject.CommonName, nil
+}
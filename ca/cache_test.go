@@ -0,0 +1,114 @@
+package ca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCertCache(t *testing.T) {
+	a, err := Generate("Test CA", "Clarity", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	c, err := NewCertCache(a, dir, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := c.Get("A.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Cert)
+	if _, err := first.Leaf.Verify(x509.VerifyOptions{DNSName: "a.example.com", Roots: roots}); err != nil {
+		t.Errorf("Invalid leaf certificate: %s", err)
+	}
+	if again, _ := c.Get("a.example.com"); again != first {
+		t.Errorf("Expected a cache hit")
+	}
+	c.Get("b.example.com")
+	c.Get("10.0.0.1")
+	if _, err := os.Stat(c.path("a.example.com")); !os.IsNotExist(err) {
+		t.Errorf("The least recently used certificate must be evicted from the disk")
+	}
+
+	// a restart reads the certificates back
+	c, err = NewCertCache(a, dir, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 2 || c.entries["10.0.0.1"] == nil {
+		t.Errorf("Expected the certificates from the disk, got %v", c.entries)
+	}
+
+	// the files of another CA are unreadable and dropped
+	b, _ := Generate("Other CA", "Clarity", time.Hour)
+	c, err = NewCertCache(b, dir, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(c.entries) != 0 || len(files) != 0 {
+		t.Errorf("Expected an empty cache, got %d entries and %d files", len(c.entries), len(files))
+	}
+}
+
+func TestCertCacheRenewal(t *testing.T) {
+	a, _ := Generate("Test CA", "Clarity", time.Hour)
+	c, err := NewCertCache(a, t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.Get("example.com")
+	// in the last quarter of its validity
+	c.validity = 8 * time.Hour
+	if cert, _ := c.Get("example.com"); cert != first {
+		t.Errorf("The current certificate must be served during the renewal")
+	}
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		renewed := c.entries["example.com"].Value.(*leaf).cert != first
+		c.mu.Unlock()
+		if renewed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("The certificate was not renewed")
+}
+
+func TestCertCacheConcurrentMisses(t *testing.T) {
+	a, _ := Generate("Test CA", "Clarity", time.Hour)
+	c, err := NewCertCache(a, t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := make(chan *tls.Certificate, 10)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			cert, err := c.Get("example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			certs <- cert
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(certs)
+	first := <-certs
+	for cert := range certs {
+		if cert != first {
+			t.Fatalf("Expected the lookups to share one certificate")
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package ca
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+)
+
+// Formats the certificates can be exported in.
+const (
+	FormatPEM          = "pem"
+	FormatDER          = "der"
+	FormatMobileConfig = "mobileconfig"
+)
+
+// Export writes the certificates in the format. DER holds a single
+// certificate, the first one.
+func Export(w io.Writer, certs []*x509.Certificate, format string) error {
+	switch format {
+	case FormatPEM:
+		for _, c := range certs {
+			if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatDER:
+		_, err := w.Write(certs[0].Raw)
+		return err
+	case FormatMobileConfig:
+		return mobileConfig.Execute(w, certs)
+	}
+	return fmt.Errorf("unknown export format: %s", format)
+}
+
+// ContentType returns the MIME type of the export format.
+func ContentType(format string) string {
+	switch format {
+	case FormatDER:
+		return "application/x-x509-ca-cert"
+	case FormatMobileConfig:
+		return "application/x-apple-aspen-config"
+	}
+	return "application/x-pem-file"
+}
+
+// NewHandler serves the certificates to trust in the format, so devices can
+// install them from the proxy.
+func NewHandler(s *Store, format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		certs, err := s.Trusted()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType(format))
+		Export(w, certs, format)
+	})
+}
+
+// uuid derives a stable UUID from the data, so that exporting the same
+// certificates again updates the installed profile instead of adding one.
+func uuid(data []byte) string {
+	s := sha256.Sum256(data)
+	return fmt.Sprintf("%X-%X-%X-%X-%X", s[0:4], s[4:6], s[6:8], s[8:10], s[10:16])
+}
+
+func profileUUID(certs []*x509.Certificate) string {
+	var all []byte
+	for _, c := range certs {
+		all = append(all, c.Raw...)
+	}
+	return uuid(all)
+}
+
+var mobileConfig = template.Must(template.New("mobileconfig").Funcs(map[string]any{
+	"base64":      func(c *x509.Certificate) string { return base64.StdEncoding.EncodeToString(c.Raw) },
+	"uuid":        func(c *x509.Certificate) string { return uuid(c.Raw) },
+	"profileUUID": profileUUID,
+	"xml":         template.HTMLEscapeString,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+{{- range .}}
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>clarity-ca.cer</string>
+			<key>PayloadContent</key>
+			<data>{{base64 .}}</data>
+			<key>PayloadDisplayName</key>
+			<string>{{xml .Subject.CommonName}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.clarity.proxy.ca.{{uuid .}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{uuid .}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+{{- end}}
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>Clarity Proxy CA</string>
+	<key>PayloadIdentifier</key>
+	<string>com.clarity.proxy</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{profileUUID .}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
@@ -0,0 +1,120 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Platforms told apart by the setup, each installing the CA its own way.
+const (
+	PlatformIOS     = "ios"
+	PlatformMacOS   = "macos"
+	PlatformAndroid = "android"
+	PlatformWindows = "windows"
+	PlatformLinux   = "linux"
+	PlatformOther   = "other"
+)
+
+// Platform guesses the platform of the device from its User-Agent.
+func Platform(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad") || strings.Contains(ua, "ipod"):
+		return PlatformIOS
+	case strings.Contains(ua, "android"):
+		return PlatformAndroid
+	case strings.Contains(ua, "macintosh") || strings.Contains(ua, "mac os x"):
+		return PlatformMacOS
+	case strings.Contains(ua, "windows"):
+		return PlatformWindows
+	case strings.Contains(ua, "linux") || strings.Contains(ua, "cros"):
+		return PlatformLinux
+	}
+	return PlatformOther
+}
+
+// download is how the CA is served to a platform.
+type download struct {
+	format   string
+	filename string
+}
+
+var downloads = map[string]download{
+	PlatformIOS:   {FormatMobileConfig, "clarity-ca.mobileconfig"},
+	PlatformMacOS: {FormatMobileConfig, "clarity-ca.mobileconfig"},
+	// the certificate installer of Android only takes the .crt files
+	PlatformAndroid: {FormatDER, "clarity-ca.crt"},
+	PlatformWindows: {FormatDER, "clarity-ca.cer"},
+	PlatformLinux:   {FormatPEM, "clarity-ca.pem"},
+	PlatformOther:   {FormatPEM, "clarity-ca.pem"},
+}
+
+// SetupInfo is what the setup page shows to a device.
+type SetupInfo struct {
+	Platform     string
+	Download     string
+	CheckUrl     string
+	Certificates []SetupCert
+}
+
+type SetupCert struct {
+	Name        string
+	Fingerprint string
+	NotAfter    time.Time
+}
+
+type setupHandler struct {
+	certs    func() ([]*x509.Certificate, error)
+	checkUrl string
+}
+
+// NewSetupHandler serves the API of the setup page under /filter/setup/:
+// info tells the device what to install, ca downloads it in the format of
+// the platform, or the one asked for, and check succeeds when requested
+// through the proxy over TLS, i.e. once the device trusts the CA. checkUrl is
+// where the page finds the latter.
+func NewSetupHandler(certs func() ([]*x509.Certificate, error), checkUrl string) http.Handler {
+	return &setupHandler{certs, checkUrl}
+}
+
+func (h *setupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	platform := req.URL.Query().Get("platform")
+	if _, ok := downloads[platform]; !ok {
+		platform = Platform(req.UserAgent())
+	}
+	switch path.Base(req.URL.Path) {
+	case "check":
+		// the page asking is served over plain HTTP
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"Trusted": req.Header.Get("X-Forwarded-Proto") == "https"})
+	case "ca":
+		certs, err := h.certs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d := downloads[platform]
+		w.Header().Set("Content-Type", ContentType(d.format))
+		w.Header().Set("Content-Disposition", `attachment; filename="`+d.filename+`"`)
+		Export(w, certs, d.format)
+	case "info":
+		certs, err := h.certs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info := SetupInfo{Platform: platform, Download: "/filter/setup/ca?platform=" + platform, CheckUrl: h.checkUrl}
+		for _, c := range certs {
+			info.Certificates = append(info.Certificates, SetupCert{c.Subject.CommonName, Fingerprint(c), c.NotAfter})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	default:
+		http.NotFound(w, req)
+	}
+}
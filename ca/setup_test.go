@@ -0,0 +1,23 @@
+package ca
+
+import "testing"
+
+func TestPlatform(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15", PlatformIOS},
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15", PlatformIOS},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15", PlatformMacOS},
+		{"Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36", PlatformAndroid},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36", PlatformWindows},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0", PlatformLinux},
+		{"curl/8.0.1", PlatformOther},
+	}
+	for _, tc := range tests {
+		if got := Platform(tc.ua); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.ua, tc.want, got)
+		}
+	}
+}
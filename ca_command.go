@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/ca"
+)
+
+const caName = "Clarity Proxy CA"
+
+// caCommand manages the CA in the data directory:
+//
+//	ca generate              creates the CA unless there is one already
+//	ca export -format pem    writes the certificates to trust, pem, der or mobileconfig
+//	ca rotate -overlap 168h  creates the next CA, taking over after the overlap
+//	ca fingerprint           shows the certificates and their fingerprints
+func caCommand(args []string) {
+	if len(args) == 0 {
+		applog.Fatal(slog.Default(), "usage: clarity ca generate|export|rotate|fingerprint [flags]")
+	}
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	data := fs.String("data", "data", "directory holding the CA")
+	org := fs.String("organization", "Clarity Proxy", "organization name of a generated CA")
+	format := fs.String("format", ca.FormatPEM, "export format, pem, der or mobileconfig")
+	out := fs.String("out", "", "file to export to, standard output if empty")
+	overlap := fs.Duration("overlap", 7*24*time.Hour, "time both CAs are trusted before the next one takes over")
+	fs.Parse(args[1:])
+	s := ca.NewStore(*data)
+
+	switch args[0] {
+	case "generate":
+		a, created, err := s.LoadOrGenerate(caName, *org)
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to generate the CA", "data", *data, "err", err)
+		}
+		if !created {
+			slog.Info("keeping the existing CA", "data", *data)
+		}
+		printAuthority("Current", a)
+	case "export":
+		certs, err := s.Trusted()
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to load the CA", "data", *data, "err", err)
+		}
+		var w io.Writer = os.Stdout
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				applog.Fatal(slog.Default(), "unable to create the export", "out", *out, "err", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := ca.Export(w, certs, *format); err != nil {
+			applog.Fatal(slog.Default(), "unable to export the CA", "err", err)
+		}
+	case "rotate":
+		next, at, err := s.Rotate(*overlap)
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to rotate the CA", "data", *data, "err", err)
+		}
+		printAuthority("Next", next)
+		fmt.Printf("Takes over on the first start after %s, export the CA again so devices trust it by then.\n", at.Format(time.RFC1123))
+	case "fingerprint":
+		a, err := s.Load()
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to load the CA", "data", *data, "err", err)
+		}
+		printAuthority("Current", a)
+		next, at, err := s.Next()
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to load the next CA", "data", *data, "err", err)
+		}
+		if next != nil {
+			printAuthority("Next (from "+at.Format(time.RFC1123)+")", next)
+		}
+	default:
+		applog.Fatal(slog.Default(), "unknown ca command", "command", args[0])
+	}
+}
+
+func printAuthority(title string, a *ca.Authority) {
+	fmt.Printf("%s: %s\n  Valid: %s - %s\n  SHA-256: %s\n", title, a.Cert.Subject,
+		a.Cert.NotBefore.Format("2006-01-02"), a.Cert.NotAfter.Format("2006-01-02"), ca.Fingerprint(a.Cert))
+}
@@ -1,11 +1,13 @@
 package config
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
 	"gopkg.in/yaml.v3"
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/util"
 )
 
 // Overall policy for a path
@@ -20,11 +22,101 @@ type Policy struct {
 	MaxAllowed time.Duration
 }
 
+// SearchEngine tells how to recognize a search and extract its query.
+type SearchEngine struct {
+	Engine string
+	// host/path of the search requests, e.g. google.com/search
+	Match string
+	// query string or form field holding the query
+	Param string
+	// dot separated path of the query in a JSON request body
+	Json string
+}
+
+type RedactConfig struct {
+	// Form fields, JSON keys and query params containing any of these words
+	// (case insensitive) are redacted, on top of a built in list of common
+	// password, token, cookie and ssn names.
+	Fields []string
+	// Don't redact numbers passing the Luhn check, i.e. card numbers
+	KeepCardNumbers bool `yaml:"keep-card-numbers"`
+}
+
+// BodyConfig controls which request and response bodies a log sink stores.
+type BodyConfig struct {
+	// Don't store bodies at all
+	Disabled bool
+	// Bytes kept of request and response bodies, default to 16KiB and 4KiB
+	MaxRequest  int `yaml:"max-request"`
+	MaxResponse int `yaml:"max-response"`
+	// Content types stored, e.g. text/* or *json. Defaults to text, JSON
+	// and url encoded forms.
+	Allow []string
+	// Content types never stored, takes precedence over Allow
+	Deny []string
+}
+
 type LogsConfig struct {
 	Provider string
 	Config   map[string]string
 	// Don't log these garbage hosts/path (or host + / + path)
 	SkipLogging []string `yaml:"skip-logging"`
+	// Only log requests of these classes (page, xhr, media, asset, telemetry,
+	// tunnel, dns, other). Everything is logged if empty.
+	Classes []string
+	// Hosts/paths classified as telemetry on top of the built in heuristics
+	Telemetry []string
+	// Searches made on these engines are logged as search events
+	SearchEngines []SearchEngine `yaml:"search-engines"`
+	// Sensitive data stripped from the URLs and bodies before logging
+	Redact RedactConfig
+	// Body capture of this log sink
+	Body BodyConfig
+}
+
+// PinningConfig tells how hosts rejecting the MITM certificates, usually
+// because they pin theirs, are detected.
+type PinningConfig struct {
+	// Skip the detected hosts right away instead of listing them for review
+	AutoSkip bool `yaml:"auto-skip"`
+	// Rejected handshakes within the window for a host to be detected,
+	// defaults to 3 in 10 minutes
+	Threshold int
+	Window    time.Duration
+}
+
+// DnsConfig is the configuration of the built in DNS server.
+type DnsConfig struct {
+	// host:port of the server the allowed queries are forwarded to, defaults
+	// to 8.8.8.8:53
+	Upstream string
+	// Address the blocked hosts resolve to, usually the one of the proxy to
+	// show the block page. They don't resolve (NXDOMAIN) if empty.
+	BlockIP string `yaml:"block-ip"`
+	// Time to wait for the upstream server, defaults to 5s
+	Timeout time.Duration
+}
+
+// UpstreamConfig routes the connections to the servers through other proxies,
+// e.g. the one a network requires.
+type UpstreamConfig struct {
+	// URL of the proxy of the hosts no rule matches: http://, https:// or
+	// socks5://, with the credentials in it if needed. Direct if empty.
+	Proxy string
+	// The first rule matching a host applies
+	Rules []UpstreamRule
+	// PEM file of root CAs trusted on top of the system ones
+	RootCAs string `yaml:"root-cas"`
+	// Servers whose certificate isn't verified, e.g. the admin page of a
+	// router or a NAS: domains, IPs or CIDR networks
+	Insecure []string
+}
+
+type UpstreamRule struct {
+	// Domains, including their subdomains, IPs or CIDR networks
+	Hosts []string
+	// URL of the proxy, or "direct"
+	Proxy string
 }
 
 type Config struct {
@@ -32,20 +124,43 @@ type Config struct {
 	Logs     LogsConfig
 	// Hosts that have pinned certificates, e.g., icloud
 	SkipProxy []string `yaml:"skip-proxy"`
+	// Detection of more of them
+	Pinning PinningConfig
 	// Compeletely blocked sites
 	Blocked []string
+	// Built in DNS server, when enabled
+	Dns DnsConfig
+	// Proxies the servers are reached through, directly by default
+	Upstream UpstreamConfig
+	// Accesses further apart than this start a new session when accounting
+	// for active time. Defaults to util.DefaultSessionGap.
+	SessionGap time.Duration `yaml:"session-gap"`
 }
 
 func NewConfig() *Config {
 	data, err := os.ReadFile("config.yaml")
 	if err != nil {
-		log.Fatal("Unable to open config file config.yaml")
+		applog.Fatal(slog.Default(), "unable to open config file", "file", "config.yaml", "err", err)
 	}
 	var config Config
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
-		log.Fatalf("Unable to parse config: %s", err)
+		applog.Fatal(slog.Default(), "unable to parse config", "file", "config.yaml", "err", err)
+	}
+	if config.SessionGap == 0 {
+		config.SessionGap = util.DefaultSessionGap
+	}
+	if config.Pinning.Threshold == 0 {
+		config.Pinning.Threshold = 3
+	}
+	if config.Pinning.Window == 0 {
+		config.Pinning.Window = 10 * time.Minute
+	}
+	if config.Dns.Upstream == "" {
+		config.Dns.Upstream = "8.8.8.8:53"
+	}
+	if config.Dns.Timeout == 0 {
+		config.Dns.Timeout = 5 * time.Second
 	}
-	log.Printf("%v", config.SkipProxy)
 	return &config
 }
@@ -86,6 +86,12 @@ func (tr *TimeRange) InRange(t time.Time) bool {
 	return tr.Begin.isBefore(&t2) && t2.isBefore(&tr.End)
 }
 
+// EndOn is the end of the range on the day of t.
+func (tr *TimeRange) EndOn(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, int(tr.End.Hour), int(tr.End.Minute), int(tr.End.Second), 0, t.Location())
+}
+
 func (tr TimeRange) String() string {
 	return fmt.Sprintf("%s - %s", &tr.Begin, &tr.End)
 }
@@ -0,0 +1,246 @@
+// Package dns is a forwarding DNS server applying the filter to the hosts
+// queried, for the apps ignoring the proxy settings.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/filter"
+	"shawnma.com/clarity/logging"
+)
+
+var log = applog.For("dns")
+
+// TTL of the answers for the blocked hosts, short for the schedules to apply
+// soon after they change
+const blockTTL = 60
+
+const maxMessageSize = 65535
+
+type Server struct {
+	filter   *filter.Filter
+	log      logging.AccessLogger
+	upstream string
+	blockIP  net.IP
+	timeout  time.Duration
+}
+
+func NewServer(c *config.Config, f *filter.Filter, l logging.AccessLogger) *Server {
+	s := &Server{filter: f, log: logging.NewClassFilter(c, l), upstream: c.Dns.Upstream, timeout: c.Dns.Timeout}
+	if c.Dns.BlockIP != "" {
+		if s.blockIP = net.ParseIP(c.Dns.BlockIP); s.blockIP == nil {
+			applog.Fatal(log, "invalid block-ip", "ip", c.Dns.BlockIP)
+		}
+	}
+	return s
+}
+
+// ServeUDP answers the queries received on pc until it fails.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	for {
+		// queries are small, unlike some answers
+		buf := make([]byte, 4096)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if res := s.resolve(addr.String(), buf[:n], "udp"); res != nil {
+				pc.WriteTo(res, addr)
+			}
+		}()
+	}
+}
+
+// ServeTCP answers the queries of the connections accepted by l until it
+// fails.
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	for {
+		c.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		req, err := readTCP(c)
+		if err != nil {
+			return
+		}
+		res := s.resolve(c.RemoteAddr().String(), req, "tcp")
+		if res == nil || writeTCP(c, res) != nil {
+			return
+		}
+	}
+}
+
+// resolve answers the query of the client, nil if it can't be answered.
+func (s *Server) resolve(client string, req []byte, network string) []byte {
+	start := time.Now()
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		log.Debug("no question", "client", client, "err", err)
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	entry := &logging.HttpLog{
+		Time:       start,
+		RemoteAddr: client,
+		Method:     strings.TrimPrefix(q.Type.String(), "Type"),
+		Url:        host,
+		Class:      logging.ClassDns,
+	}
+
+	var res []byte
+	decision, e := s.filter.CheckLookup(host, log.With("client", client))
+	if e != nil {
+		entry.Policy = e.Policy.Path
+	}
+	if decision != "" {
+		log.Info("query "+decision, "client", client, "host", host, "policy", entry.Policy)
+		entry.Decision = decision
+		res, err = s.refuse(h, q)
+	} else {
+		res, err = s.forward(req, network)
+		if err != nil {
+			log.Info("upstream failed", "host", host, "err", err)
+			res, err = reply(h, q, dnsmessage.RCodeServerFailure)
+		}
+	}
+	if err != nil {
+		return nil
+	}
+	if rh, err := new(dnsmessage.Parser).Start(res); err == nil {
+		entry.ResponseCode = int(rh.RCode)
+	}
+	entry.ResponseLength = len(res)
+	entry.Duration = time.Since(start)
+	logging.CountRequest(entry)
+	s.log.Log(entry)
+	return res
+}
+
+// refuse answers the query for a blocked host, with the block IP if it's of
+// the asked type.
+func (s *Server) refuse(h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	if s.blockIP == nil {
+		return reply(h, q, dnsmessage.RCodeNameError)
+	}
+	b, err := answer(h, q, dnsmessage.RCodeSuccess)
+	if err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: blockTTL}
+	if ip4 := s.blockIP.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+		r := dnsmessage.AResource{}
+		copy(r.A[:], ip4)
+		err = b.AResource(rh, r)
+	} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+		r := dnsmessage.AAAAResource{}
+		copy(r.AAAA[:], s.blockIP.To16())
+		err = b.AAAAResource(rh, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// forward sends the query to the upstream server, over the network it was
+// received from.
+func (s *Server) forward(req []byte, network string) ([]byte, error) {
+	c, err := net.DialTimeout(network, s.upstream, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(s.timeout))
+	if network == "tcp" {
+		if err := writeTCP(c, req); err != nil {
+			return nil, err
+		}
+		return readTCP(c)
+	}
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 2 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(req) {
+		return nil, errors.New("unexpected answer")
+	}
+	return buf[:n], nil
+}
+
+// reply is an answer to the query with only a response code.
+func reply(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode) ([]byte, error) {
+	b, err := answer(h, q, rcode)
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// answer builds an answer to the query, up to its answer section.
+func answer(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode) (*dnsmessage.Builder, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// readTCP reads a message prefixed with its length.
+func readTCP(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCP(w io.Writer, msg []byte) error {
+	b := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
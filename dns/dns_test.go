@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/filter"
+	"shawnma.com/clarity/logging"
+)
+
+type memLogger struct {
+	logs []*logging.HttpLog
+}
+
+func (l *memLogger) Log(h *logging.HttpLog)           { l.logs = append(l.logs, h) }
+func (l *memLogger) LogSearch(e *logging.SearchEvent) {}
+
+// upstream answers every A query with 192.0.2.1.
+func upstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, _ := p.Start(buf[:n])
+			q, _ := p.Question()
+			b, _ := answer(h, q, dnsmessage.RCodeSuccess)
+			b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 300}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+			res, _ := b.Finish()
+			pc.WriteTo(res, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func query(t *testing.T, s *Server, host string, qtype dnsmessage.Type) (dnsmessage.RCode, []dnsmessage.Resource) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(host + "."), Type: qtype, Class: dnsmessage.ClassINET})
+	req, _ := b.Finish()
+	res := s.resolve("10.0.0.1:5353", req, "udp")
+	var m dnsmessage.Message
+	if err := m.Unpack(res); err != nil {
+		t.Fatalf("%s: %s", host, err)
+	}
+	if m.ID != 42 {
+		t.Errorf("%s: expected ID 42, got %d", host, m.ID)
+	}
+	return m.RCode, m.Answers
+}
+
+func TestResolve(t *testing.T) {
+	c := &config.Config{
+		Policies: []config.Policy{{Path: "youtube.com"}},
+		Blocked:  []string{"doubleclick.net"},
+		Logs:     config.LogsConfig{Classes: []string{"page"}},
+		Dns:      config.DnsConfig{Upstream: upstream(t), Timeout: time.Second},
+	}
+	l := &memLogger{}
+	s := NewServer(c, filter.NewFilter(c, l), l)
+
+	rcode, answers := query(t, s, "Example.com", dnsmessage.TypeA)
+	if rcode != dnsmessage.RCodeSuccess || len(answers) != 1 {
+		t.Errorf("Expected the upstream answer, got %v with %d answers", rcode, len(answers))
+	}
+	if rcode, _ := query(t, s, "www.youtube.com", dnsmessage.TypeA); rcode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected a denied host not to resolve, got %v", rcode)
+	}
+	if rcode, _ := query(t, s, "stats.doubleclick.net", dnsmessage.TypeA); rcode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected a blocked host not to resolve, got %v", rcode)
+	}
+	// the allowed query isn't of a logged class
+	if len(l.logs) != 2 || l.logs[0].Url != "www.youtube.com" || l.logs[0].Decision != logging.DecisionDenied || l.logs[0].Method != "A" {
+		t.Errorf("Expected the refused queries to be logged, got %v", l.logs)
+	}
+
+	s.blockIP = net.ParseIP("192.168.1.1")
+	rcode, answers = query(t, s, "doubleclick.net", dnsmessage.TypeA)
+	if rcode != dnsmessage.RCodeSuccess || len(answers) != 1 || answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 168, 1, 1} {
+		t.Errorf("Expected the block IP, got %v with %v", rcode, answers)
+	}
+	if rcode, answers := query(t, s, "doubleclick.net", dnsmessage.TypeAAAA); rcode != dnsmessage.RCodeSuccess || len(answers) != 0 {
+		t.Errorf("Expected no IPv6 address, got %v with %v", rcode, answers)
+	}
+}
+
+func TestResolveUpstreamDown(t *testing.T) {
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	c := &config.Config{Dns: config.DnsConfig{Upstream: addr, Timeout: 100 * time.Millisecond}}
+	l := &memLogger{}
+	s := NewServer(c, filter.NewFilter(c, l), l)
+	if rcode, _ := query(t, s, "example.com", dnsmessage.TypeA); rcode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected a server failure, got %v", rcode)
+	}
+}
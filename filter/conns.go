@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"shawnma.com/clarity/metrics"
+)
+
+// The decisions are made per request, while the connections of the clients
+// outlive them: kept alive, or carrying a long download. The connections are
+// registered by the address of their client, and closed when an entry which
+// allowed the client stops allowing it, for the next request to be denied.
+
+// How long the scheduler waits at most, when nothing in use ends sooner.
+const maxCheckInterval = time.Hour
+
+var terminatedConns = metrics.NewCounterVec("clarity_connections_terminated_total",
+	"Client connections closed at the end of the allowance of a policy.", "policy")
+
+type conns struct {
+	mu sync.Mutex
+	// open connections, by client address
+	m map[string]map[net.Conn]bool
+	// clients allowed by each entry, while they have connections
+	clients map[*Entry]map[string]bool
+}
+
+// Listener registers the connections accepted by l, for them to be closed
+// when the policy allowing their client stops allowing it.
+func (f *Filter) Listener(l net.Listener) net.Listener {
+	return &listener{l, f}
+}
+
+type listener struct {
+	net.Listener
+	f *Filter
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &conn{Conn: c, f: l.f, client: c.RemoteAddr().String()}
+	l.f.conns.add(tc)
+	return tc, nil
+}
+
+type conn struct {
+	net.Conn
+	f      *Filter
+	client string
+	once   sync.Once
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { c.f.conns.remove(c) })
+	return c.Conn.Close()
+}
+
+func (cs *conns) add(c *conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.m == nil {
+		cs.m = map[string]map[net.Conn]bool{}
+	}
+	if cs.m[c.client] == nil {
+		cs.m[c.client] = map[net.Conn]bool{}
+	}
+	cs.m[c.client][c] = true
+}
+
+func (cs *conns) remove(c *conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.m[c.client], c)
+	if len(cs.m[c.client]) > 0 {
+		return
+	}
+	delete(cs.m, c.client)
+	for e, clients := range cs.clients {
+		delete(clients, c.client)
+		if len(clients) == 0 {
+			delete(cs.clients, e)
+		}
+	}
+}
+
+// bind records that the entry allowed the client, which has connections to
+// close once the entry doesn't anymore.
+func (f *Filter) bind(e *Entry, client string) {
+	f.conns.mu.Lock()
+	defer f.conns.mu.Unlock()
+	if len(f.conns.m[client]) == 0 || f.conns.clients[e][client] {
+		return
+	}
+	if f.conns.clients == nil {
+		f.conns.clients = map[*Entry]map[string]bool{}
+	}
+	if f.conns.clients[e] == nil {
+		f.conns.clients[e] = map[string]bool{}
+		// it may end before the next check
+		f.wakeScheduler()
+	}
+	f.conns.clients[e][client] = true
+}
+
+// closeConns closes the connections of the clients of the entries which
+// don't allow them anymore.
+func (f *Filter) closeConns(now time.Time) {
+	f.conns.mu.Lock()
+	var expired []net.Conn
+	for e, clients := range f.conns.clients {
+		if f.allows(e, now) {
+			continue
+		}
+		for client := range clients {
+			log.Info("closing connections", "client", client, "policy", e.Policy.Path)
+			for c := range f.conns.m[client] {
+				terminatedConns.Inc(e.Policy.Path)
+				expired = append(expired, c)
+			}
+		}
+		delete(f.conns.clients, e)
+	}
+	f.conns.mu.Unlock()
+	// they unregister themselves
+	for _, c := range expired {
+		c.Close()
+	}
+}
+
+func (f *Filter) wakeScheduler() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule ends the connections and the streams when their entries stop
+// allowing them, checking them at the earliest time one may.
+func (f *Filter) schedule() {
+	t := time.NewTimer(maxCheckInterval)
+	for {
+		select {
+		case <-t.C:
+		case <-f.wake:
+		}
+		now := time.Now()
+		f.checkStreams(now)
+		f.closeConns(now)
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(f.nextCheck(now).Sub(now))
+	}
+}
+
+// nextCheck is the earliest time an entry in use may stop allowing it.
+func (f *Filter) nextCheck(now time.Time) time.Time {
+	next := now.Add(maxCheckInterval)
+	var entries []*Entry
+	f.streams.mu.Lock()
+	for e := range f.streams.m {
+		entries = append(entries, e)
+	}
+	if len(f.streams.m) > 0 {
+		// the open streams are accounted as they go
+		next = now.Add(streamCheckInterval)
+	}
+	f.streams.mu.Unlock()
+	f.conns.mu.Lock()
+	for e := range f.conns.clients {
+		entries = append(entries, e)
+	}
+	f.conns.mu.Unlock()
+	for _, e := range entries {
+		if d := f.deadline(e, now); !d.IsZero() && d.Before(next) {
+			next = d
+		}
+	}
+	return next
+}
+
+// deadline is the earliest time the entry may stop allowing the access it
+// allows at now: the end of its temporary allowance, of its time range, or of
+// its quota if used all along. It's zero if none applies.
+func (f *Filter) deadline(e *Entry, now time.Time) time.Time {
+	if e.ExpireTime != nil && e.ExpireTime.After(now) {
+		return *e.ExpireTime
+	}
+	var d time.Time
+	for _, r := range e.Policy.AllowedRange {
+		if r.InRange(now) {
+			if end := r.EndOn(now); end.After(d) {
+				d = end
+			}
+		}
+	}
+	if p := e.Policy.MaxAllowed; p > 0 {
+		if q := now.Add(p - f.usedToday(e, now)); d.IsZero() || q.Before(d) {
+			d = q
+		}
+	}
+	return d
+}
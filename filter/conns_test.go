@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"shawnma.com/clarity/config"
+)
+
+func TestDeadline(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	at := func(h, m int) time.Time {
+		return time.Date(2024, 1, 1, h, m, 0, 0, time.Local)
+	}
+	morning, _ := config.NewTimeRange("8:00", "11:00")
+	day, _ := config.NewTimeRange("9:00", "17:00")
+	evening, _ := config.NewTimeRange("18:00", "20:00")
+	expiry := at(10, 15)
+	tests := []struct {
+		name     string
+		e        *Entry
+		deadline time.Time
+	}{
+		{"range", &Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{*morning, *evening}}}, at(11, 0)},
+		{"overlapping ranges", &Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{*morning, *day}}}, at(17, 0)},
+		{"quota", &Entry{Policy: config.Policy{MaxAllowed: time.Hour}, UsedDuration: 20 * time.Minute, LastAccessTime: at(9, 0)}, at(10, 40)},
+		{"quota in range", &Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{*morning}, MaxAllowed: 2 * time.Hour}}, at(11, 0)},
+		{"temporary", &Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{*day}}, ExpireTime: &expiry}, expiry},
+		{"none", &Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{*evening}}}, time.Time{}},
+	}
+	f := NewFilter(&config.Config{SessionGap: time.Minute}, nil)
+	for _, tc := range tests {
+		if d := f.deadline(tc.e, now); !d.Equal(tc.deadline) {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.deadline, d)
+		}
+	}
+}
+
+func TestCloseConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFilter(&config.Config{SessionGap: time.Minute}, nil)
+	tl := f.Listener(l)
+	defer tl.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc, err := tl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	now := time.Now()
+	expiry := now.Add(time.Minute)
+	e := &Entry{Policy: config.Policy{Path: "youtube.com"}, ExpireTime: &expiry}
+	f.bind(e, c.LocalAddr().String())
+	if d := f.nextCheck(now); !d.Equal(expiry) {
+		t.Errorf("Expected a check at the expiry %s, got %s", expiry, d)
+	}
+	f.closeConns(now)
+	if len(f.conns.m) != 1 {
+		t.Fatal("Expected the connection to stay open until the expiry")
+	}
+	f.closeConns(expiry)
+	if len(f.conns.m) != 0 || len(f.conns.clients) != 0 {
+		t.Errorf("Expected the connection to be closed, got %v, %v", f.conns.m, f.conns.clients)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the client to see the connection closed")
+	}
+}
@@ -2,16 +2,27 @@ package filter
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/martian/v3"
+	"shawnma.com/clarity/applog"
 	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/logging"
+	"shawnma.com/clarity/metrics"
 	"shawnma.com/clarity/util"
 )
 
+var log = applog.For("filter")
+
+var policyDenied = metrics.NewCounterVec("clarity_policy_denied_total",
+	"Requests denied by each policy.", "id", "policy")
+
 type Entry struct {
 	Id     int
 	Policy config.Policy
@@ -22,20 +33,34 @@ type Entry struct {
 }
 
 type Filter struct {
+	// receives the requests the filter stopped, which never reach the
+	// response logger
+	log logging.AccessLogger
+	// guards the usage accounting in entries
+	mu  sync.Mutex
+	gap time.Duration
 	// configureable hosts
 	tree *util.UrlMatch[*Entry]
 	// skipped hosts
 	skip *util.UrlMatch[bool]
+	// skipped hosts detected at runtime, optional
+	learned *LearnedSkip
 	// blacklisted hosts
 	blocked *util.UrlMatch[bool]
+	// long lived connections, by the entry allowing them
+	streams streams
+	// client connections, and the entries allowing their clients
+	conns conns
+	// wakes the scheduler up for an entry newly in use
+	wake chan struct{}
 }
 
-func NewFilter(config *config.Config) *Filter {
-	f := &Filter{}
+func NewFilter(config *config.Config, l logging.AccessLogger) *Filter {
+	f := &Filter{log: l, gap: config.SessionGap, wake: make(chan struct{}, 1)}
 	f.tree = &util.UrlMatch[*Entry]{}
 
 	for id, p := range config.Policies {
-		log.Printf("Loading policy: %v", p)
+		log.Info("loading policy", "id", id, "path", p.Path)
 		f.tree.Add(p.Path, &Entry{Id: id, Policy: p})
 	}
 
@@ -51,50 +76,216 @@ func NewFilter(config *config.Config) *Filter {
 		f.blocked.Add(h, true)
 	}
 
+	go f.schedule()
 	return f
 }
 
+// SetLearnedSkip makes the filter skip the hosts learned to reject the MITM
+// certificates, on top of the configured ones.
+func (f *Filter) SetLearnedSkip(l *LearnedSkip) {
+	f.learned = l
+}
+
 // ModifyRequest return 403 if an entry is matched
 func (f *Filter) ModifyRequest(req *http.Request) error {
 	ctx := martian.NewContext(req)
 	url := req.URL
-	if f.skip.Match(url.Hostname(), url.Path) {
-		log.Printf("Skipping url %s", url)
+	log := log.With("request", ctx.ID())
+	if f.Skipped(url.Hostname(), url.Path) {
+		log.Debug("skipping MITM", "url", url)
 		ctx.Session().SkipMitm()
+		if req.Method == "CONNECT" {
+			// the tunnel is opaque, only its host can be filtered
+			return f.filterTunnel(ctx, req.RemoteAddr, url.Hostname(), log)
+		}
 		return nil
 	}
 	if f.blocked.Match(url.Hostname(), url.Path) {
-		log.Printf("blocked url %s", url)
+		log.Info("blocked", "url", url)
+		f.logDecision(ctx, logging.DecisionBlocked, "", 400)
 		return hijack(ctx, "HTTP/1.1 400 Bad Request\nConnection: Close\n\n")
 	}
 	if req.Method == "CONNECT" || req.URL.Hostname() == "clarity.proxy" {
 		return nil // proxy connect method, ignore.
 	}
-	var failedEntry *Entry = nil
-	// log.Printf("Filter: %s host %s", path, url.Hostname())
-	err := f.tree.Walk(url.Hostname(), url.Path, func(key string, value *Entry) error {
-		log.Printf("walking %s", key)
-		if value.ExpireTime != nil && value.ExpireTime.After(time.Now()) {
-			// TODO: update last access time?
-			log.Printf("path %s allowed as it is has not expired\n", key)
-			return nil // we have a temp authorization
+	failedEntry, matched := f.evaluate(url.Hostname(), url.Path, log)
+	if failedEntry != nil {
+		log.Info("denied", "url", url, "policy", failedEntry.Policy.Path)
+		policyDenied.Inc(strconv.Itoa(failedEntry.Id), failedEntry.Policy.Path)
+		f.logDecision(ctx, logging.DecisionDenied, failedEntry.Policy.Path, 302)
+		return hijack(ctx, fmt.Sprintf("HTTP/1.1 302 moved\nLocation: https://theswea.com/filter/blocked.html#%d\nConnection: Close\n\n", failedEntry.Id))
+	}
+	if matched != nil {
+		if h := logging.FromContext(ctx); h != nil {
+			h.Policy = matched.Policy.Path
 		}
-		p := value.Policy
-		for _, r := range p.AllowedRange {
-			if r.InRange(time.Now()) {
-				log.Printf("path %s allowed as it is in range: %v\n", key, r)
-				return nil
+		ctx.Set(entryKey, matched)
+		f.recordUsage(matched, time.Now())
+		f.bind(matched, req.RemoteAddr)
+	}
+	return nil
+}
+
+// Skipped tells whether the traffic of the host is not intercepted.
+func (f *Filter) Skipped(host, path string) bool {
+	return f.skip.Match(host, path) || (f.learned != nil && f.learned.Skipped(host))
+}
+
+// CheckHost decides on a connection which is not intercepted, from its host
+// alone: the blocked sites and the policies of whole hosts apply. It returns
+// the decision, empty if allowed, and the policy entry which decided, if any.
+func (f *Filter) CheckHost(host string, log *slog.Logger) (string, *Entry) {
+	decision, e := f.CheckLookup(host, log)
+	if decision == "" && e != nil {
+		f.recordUsage(e, time.Now())
+	}
+	return decision, e
+}
+
+// CheckLookup decides on a name lookup as CheckHost does, without accounting
+// it as an access to the host: the lookups happen ahead of the visits, if any.
+func (f *Filter) CheckLookup(host string, log *slog.Logger) (string, *Entry) {
+	if f.blocked.Match(host, "/") {
+		return logging.DecisionBlocked, nil
+	}
+	failedEntry, matched := f.evaluate(host, "/", log)
+	if failedEntry != nil {
+		policyDenied.Inc(strconv.Itoa(failedEntry.Id), failedEntry.Policy.Path)
+		return logging.DecisionDenied, failedEntry
+	}
+	return "", matched
+}
+
+// filterTunnel closes the CONNECT tunnel if its host is not allowed.
+func (f *Filter) filterTunnel(ctx *martian.Context, client, host string, log *slog.Logger) error {
+	decision, e := f.CheckHost(host, log)
+	policy := ""
+	if e != nil {
+		policy = e.Policy.Path
+	}
+	if decision == "" {
+		if e != nil {
+			if h := logging.FromContext(ctx); h != nil {
+				h.Policy = policy
 			}
+			f.bind(e, client)
+		}
+		return nil
+	}
+	log.Info("tunnel "+decision, "host", host, "policy", policy)
+	f.logDecision(ctx, decision, policy, 403)
+	return hijack(ctx, "HTTP/1.1 403 Forbidden\nConnection: Close\n\n")
+}
+
+// AllowTunnel tells whether the client may reach the host at addr through a
+// tunnel which is not intercepted, such as a connection to the transparent
+// listener, logging the refusals. The allowed tunnels are logged by whoever
+// splices them, once over.
+func (f *Filter) AllowTunnel(client, host, addr string) bool {
+	log := log.With("client", client)
+	decision, e := f.CheckHost(host, log)
+	if decision == "" {
+		if e != nil {
+			f.bind(e, client)
+		}
+		return true
+	}
+	policy := ""
+	if e != nil {
+		policy = e.Policy.Path
+	}
+	log.Info("tunnel "+decision, "host", host, "policy", policy)
+	h := &logging.HttpLog{
+		Time:       time.Now(),
+		RemoteAddr: client,
+		Method:     "CONNECT",
+		Url:        addr,
+		Class:      logging.ClassTunnel,
+		Policy:     policy,
+		Decision:   decision,
+	}
+	logging.CountRequest(h)
+	f.log.Log(h)
+	return false
+}
+
+// evaluate walks the policies matching the host and path. The first one
+// which doesn't allow the access at this time is returned as failed,
+// otherwise matched is the most specific one.
+func (f *Filter) evaluate(host, path string, log *slog.Logger) (failed, matched *Entry) {
+	now := time.Now()
+	f.tree.Walk(host, path, func(key string, value *Entry) error {
+		matched = value
+		if f.allows(value, now) {
+			log.Debug("allowed", "policy", key)
+			return nil
 		}
-		failedEntry = value
+		failed = value
 		// rule matched, but neither is allowed, it must be denied
 		return fmt.Errorf("rule denied at path %s when evaluating %+v", key, value)
 	})
-	log.Printf("final decision for %s, %v\n", url, err)
-	if err != nil {
-		return hijack(ctx, fmt.Sprintf("HTTP/1.1 302 moved\nLocation: https://theswea.com/filter/blocked.html#%d\nConnection: Close\n\n", failedEntry.Id))
+	return failed, matched
+}
+
+// allows tells whether the entry allows the access at the time: until the
+// expiry of a temporary allowance, otherwise within its ranges, if any, and
+// its daily quota, if any. An entry with neither never allows it.
+func (f *Filter) allows(e *Entry, now time.Time) bool {
+	if e.ExpireTime != nil && e.ExpireTime.After(now) {
+		// TODO: update last access time?
+		return true
 	}
-	return nil
+	p := e.Policy
+	if len(p.AllowedRange) == 0 && p.MaxAllowed == 0 {
+		return false
+	}
+	if len(p.AllowedRange) > 0 && !slices.ContainsFunc(p.AllowedRange, func(r config.TimeRange) bool { return r.InRange(now) }) {
+		return false
+	}
+	return p.MaxAllowed == 0 || f.usedToday(e, now) < p.MaxAllowed
+}
+
+// usedToday is the active time accounted to the entry on the day of now.
+func (f *Filter) usedToday(e *Entry, now time.Time) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !sameDay(e.LastAccessTime, now) {
+		return 0
+	}
+	return e.UsedDuration
+}
+
+func sameDay(t1, t2 time.Time) bool {
+	y1, m1, d1 := t1.Date()
+	y2, m2, d2 := t2.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+// recordUsage accounts the active time of an allowed access to the entry,
+// starting over every day.
+func (f *Filter) recordUsage(e *Entry, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !sameDay(e.LastAccessTime, now) {
+		e.UsedDuration = 0
+		e.LastAccessTime = time.Time{}
+	}
+	e.UsedDuration += util.ActiveTime(e.LastAccessTime, now, f.gap)
+	e.LastAccessTime = now
+}
+
+// logDecision logs a request the filter stopped, as the response logger never
+// sees it.
+func (f *Filter) logDecision(ctx *martian.Context, decision, policy string, code int) {
+	h := logging.FromContext(ctx)
+	if h == nil {
+		return
+	}
+	h.Decision = decision
+	h.Policy = policy
+	h.ResponseCode = code
+	logging.CountRequest(h)
+	f.log.Log(h)
 }
 
 func hijack(ctx *martian.Context, resp string) error {
@@ -1 +1,146 @@
 package filter
+
+import (
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/logging"
+)
+
+func TestCheckHost(t *testing.T) {
+	f := NewFilter(&config.Config{
+		Policies: []config.Policy{
+			{Path: "youtube.com"},
+			{Path: "aops.com/community"},
+		},
+		SkipProxy: []string{"icloud.com"},
+		Blocked:   []string{"doubleclick.net"},
+	}, nil)
+	tests := []struct {
+		host     string
+		decision string
+		policy   string
+	}{
+		{"www.youtube.com", logging.DecisionDenied, "youtube.com"},
+		{"stats.doubleclick.net", logging.DecisionBlocked, ""},
+		// policies on paths can't apply to a host
+		{"aops.com", "", ""},
+		{"example.com", "", ""},
+	}
+	for _, tc := range tests {
+		decision, e := f.CheckHost(tc.host, slog.Default())
+		policy := ""
+		if e != nil {
+			policy = e.Policy.Path
+		}
+		if decision != tc.decision || policy != tc.policy {
+			t.Errorf("%s: expected %q by %q, got %q by %q", tc.host, tc.decision, tc.policy, decision, policy)
+		}
+	}
+	if !f.Skipped("www.icloud.com", "") || f.Skipped("example.com", "") {
+		t.Errorf("Wrong skipped hosts")
+	}
+}
+
+func TestAllows(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	later := now.Add(time.Hour)
+	day := config.TimeRange{Begin: config.TimeOfDay{Hour: 8}, End: config.TimeOfDay{Hour: 20}}
+	night := config.TimeRange{Begin: config.TimeOfDay{Hour: 20}, End: config.TimeOfDay{Hour: 23}}
+	tests := []struct {
+		name  string
+		entry Entry
+		want  bool
+	}{
+		{"in range", Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{night, day}}}, true},
+		{"out of range", Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{night}}}, false},
+		{"no range nor quota", Entry{}, false},
+		{"temporary allowance", Entry{ExpireTime: &later}, true},
+		{"under quota", Entry{Policy: config.Policy{MaxAllowed: time.Hour}, UsedDuration: 59 * time.Minute, LastAccessTime: now}, true},
+		{"over quota", Entry{Policy: config.Policy{MaxAllowed: time.Hour}, UsedDuration: time.Hour, LastAccessTime: now}, false},
+		{"quota of yesterday", Entry{Policy: config.Policy{MaxAllowed: time.Hour}, UsedDuration: time.Hour, LastAccessTime: now.AddDate(0, 0, -1)}, true},
+		{"in range over quota", Entry{Policy: config.Policy{AllowedRange: []config.TimeRange{day}, MaxAllowed: time.Hour}, UsedDuration: time.Hour, LastAccessTime: now}, false},
+	}
+	f := NewFilter(&config.Config{}, nil)
+	for _, tc := range tests {
+		if got := f.allows(&tc.entry, now); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestQuotaSharedByClients(t *testing.T) {
+	f := NewFilter(&config.Config{
+		Policies: []config.Policy{{Path: "youtube.com", MaxAllowed: time.Minute}},
+	}, nil)
+	decision, e := f.CheckHost("www.youtube.com", slog.Default())
+	if decision != "" || e == nil {
+		t.Fatalf("expected the policy to allow the site, got %q", decision)
+	}
+	// the usage isn't per client: once one has used the quota, it is denied
+	// to all of them
+	e.UsedDuration, e.LastAccessTime = time.Minute, time.Now()
+	if decision, _ := f.CheckHost("m.youtube.com", slog.Default()); decision != logging.DecisionDenied {
+		t.Errorf("expected the quota to deny the site, got %q", decision)
+	}
+}
+
+type memLogger struct {
+	logs []*logging.HttpLog
+}
+
+func (l *memLogger) Log(h *logging.HttpLog)           { l.logs = append(l.logs, h) }
+func (l *memLogger) LogSearch(e *logging.SearchEvent) {}
+
+func TestAllowTunnel(t *testing.T) {
+	l := &memLogger{}
+	f := NewFilter(&config.Config{Blocked: []string{"doubleclick.net"}}, l)
+	if !f.AllowTunnel("10.0.0.2:5000", "example.com", "93.184.216.34:993") {
+		t.Error("Expected the tunnel to be allowed")
+	}
+	if f.AllowTunnel("10.0.0.2:5000", "stats.doubleclick.net", "142.250.0.1:5223") {
+		t.Error("Expected the tunnel to be refused")
+	}
+	if len(l.logs) != 1 || l.logs[0].Url != "142.250.0.1:5223" || l.logs[0].Decision != logging.DecisionBlocked {
+		t.Errorf("Expected the refusal logged with its destination, got %+v", l.logs)
+	}
+}
+
+func TestCheckLookup(t *testing.T) {
+	f := NewFilter(&config.Config{Policies: []config.Policy{{Path: "youtube.com", MaxAllowed: time.Hour}}}, nil)
+	decision, e := f.CheckLookup("www.youtube.com", slog.Default())
+	if decision != "" || e == nil {
+		t.Fatalf("Expected the lookup allowed by the policy, got %q", decision)
+	}
+	if !e.LastAccessTime.IsZero() {
+		t.Error("Expected the lookup not to be accounted")
+	}
+	f.CheckHost("www.youtube.com", slog.Default())
+	if e.LastAccessTime.IsZero() {
+		t.Error("Expected the access to be accounted")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		xff, addr string
+	}{
+		{"", "127.0.0.1:5678"},
+		{"192.168.1.20", "192.168.1.20:0"},
+		// the client made up the first address, the proxy appended the last
+		{"10.0.0.1, 192.168.1.20", "192.168.1.20:0"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/config/settings", nil)
+		req.RemoteAddr = "127.0.0.1:5678"
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientAddr(req); got != tc.addr {
+			t.Errorf("%q: expected %s, got %s", tc.xff, tc.addr, got)
+		}
+	}
+}
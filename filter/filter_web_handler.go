@@ -3,15 +3,21 @@ package filter
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
+
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/logging"
 )
 
+var apiLog = applog.For("api")
+
 func (h *Filter) HttpHandler() http.Handler {
 	fn := func(w http.ResponseWriter, req *http.Request) {
-		fmt.Println(req.URL.Path)
+		apiLog.Debug("config request", "path", req.URL.Path, "client", clientAddr(req))
 		var result any
 		switch req.URL.Path {
 		case "/config/settings":
@@ -20,6 +26,18 @@ func (h *Filter) HttpHandler() http.Handler {
 			result = h.getBlockedInfo(req)
 		case "/config/set":
 			result = h.setTemp(req)
+		case "/config/learned":
+			result = h.getLearned()
+		case "/config/learned/promote":
+			if !adminRequest(w, req) {
+				return
+			}
+			result = h.setLearned(req, LearnedSkipped)
+		case "/config/learned/demote":
+			if !adminRequest(w, req) {
+				return
+			}
+			result = h.setLearned(req, LearnedIgnored)
 		}
 		json.NewEncoder(w).Encode(result)
 	}
@@ -42,6 +60,45 @@ func (f *Filter) getBlockedInfo(req *http.Request) any {
 	return e
 }
 
+func (f *Filter) getLearned() any {
+	if f.learned == nil {
+		return []*LearnedHost{}
+	}
+	return f.learned.Hosts()
+}
+
+// setLearned promotes the host to be skipped or demotes it to be intercepted.
+func (f *Filter) setLearned(req *http.Request, status string) any {
+	if f.learned == nil {
+		return setResult{false, "Learning is not enabled"}
+	}
+	h, err := f.learned.SetStatus(req.FormValue("host"), status)
+	if err != nil {
+		return setResult{false, err.Error()}
+	}
+	apiLog.Info("learned host updated", "host", h.Host, "status", status, "client", clientAddr(req))
+	return h
+}
+
+// adminRequest tells whether the request may change what the proxy
+// intercepts: a POST made on the API listener from the machine of the proxy,
+// not one forwarded by the proxy for its clients. It answers the others with
+// an error.
+func adminRequest(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return false
+	}
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() || req.Header.Get("X-Forwarded-For") != "" {
+		apiLog.Warn("refused a change from a client", "path", req.URL.Path, "client", clientAddr(req))
+		http.Error(w, "Only allowed from the machine of the proxy", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 type setResult struct {
 	Result  bool
 	Message string
@@ -83,8 +140,27 @@ func (f *Filter) setTemp(req *http.Request) any {
 	if e == nil {
 		return setResult{false, fmt.Sprintf("Config id %d not found", id)}
 	}
-	log.Printf("ADD DURATION %s %s", e.Policy.Path, d)
+	apiLog.Info("extending policy", "policy", e.Policy.Path, "duration", d, "client", clientAddr(req))
+	f.log.Log(&logging.HttpLog{
+		Time:       t,
+		RemoteAddr: clientAddr(req),
+		Method:     req.Method,
+		Url:        req.URL.String(),
+		Title:      fmt.Sprintf("%d minutes", minutes),
+		Policy:     e.Policy.Path,
+		Decision:   logging.DecisionExtended,
+	})
 	t = t.Add(d)
 	e.ExpireTime = &t
 	return e
 }
+
+// clientAddr returns the address of the client behind the proxy, which
+// forwards API requests with X-Forwarded-For. Only the last address, the one
+// the proxy appended, is trusted: the client may have sent the others.
+func clientAddr(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(xff[strings.LastIndex(xff, ",")+1:]) + ":0"
+	}
+	return req.RemoteAddr
+}
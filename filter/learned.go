@@ -0,0 +1,193 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/util"
+)
+
+// Status of a learned host
+const (
+	// LearnedCandidate is detected, waiting for review
+	LearnedCandidate = "candidate"
+	// LearnedSkipped is not intercepted anymore
+	LearnedSkipped = "skipped"
+	// LearnedIgnored is intercepted and not detected again
+	LearnedIgnored = "ignored"
+)
+
+type LearnedHost struct {
+	Host        string
+	Status      string
+	Failures    int
+	LastFailure time.Time
+}
+
+// LearnedSkip detects the hosts whose clients reject the MITM certificate,
+// usually because they pin the certificate of the host, so that they can be
+// skipped like the ones in the skip-proxy config. Only the clients aborting
+// the handshake are detected: those checking the pins once it is over, such
+// as OkHttp, just close the connection, which is told from no other closing,
+// and their hosts must be added to skip-proxy.
+type LearnedSkip struct {
+	config config.PinningConfig
+	// file the learned hosts are kept in
+	path string
+
+	mu sync.Mutex
+	// clients known to trust the CA, the others reject every host
+	clients  util.Set[string]
+	failures map[string][]time.Time
+	hosts    map[string]*LearnedHost
+}
+
+func NewLearnedSkip(c config.PinningConfig, path string) (*LearnedSkip, error) {
+	l := &LearnedSkip{config: c, path: path, clients: util.Set[string]{},
+		failures: map[string][]time.Time{}, hosts: map[string]*LearnedHost{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var hosts []*LearnedHost
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		l.hosts[h.Host] = h
+	}
+	return l, nil
+}
+
+// HandshakeDone accounts the outcome of a TLS handshake of the client with
+// the MITM certificate of the host.
+func (l *LearnedSkip) HandshakeDone(client, host string, err error) {
+	if h, _, e := net.SplitHostPort(client); e == nil {
+		client = h
+	}
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		// clients only finish the handshake once they accept the certificate
+		l.clients.Add(client)
+		delete(l.failures, host)
+		return
+	}
+	if !rejected(err) || !l.clients.Has(client) {
+		return
+	}
+	now := time.Now()
+	recent := l.failures[host][:0]
+	for _, t := range l.failures[host] {
+		if now.Sub(t) < l.config.Window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	l.failures[host] = recent
+	if len(recent) < l.config.Threshold {
+		return
+	}
+
+	h := l.hosts[host]
+	if h == nil {
+		h = &LearnedHost{Host: host, Status: LearnedCandidate}
+		if l.config.AutoSkip {
+			h.Status = LearnedSkipped
+		}
+		l.hosts[host] = h
+		log.Info("detected a host rejecting the MITM certificate", "host", host, "status", h.Status)
+	}
+	h.Failures += len(recent)
+	h.LastFailure = now
+	delete(l.failures, host)
+	l.save()
+}
+
+// rejectAlerts are the alerts of the clients rejecting a certificate, as
+// crypto/tls reports them.
+var rejectAlerts = []string{"tls: bad certificate", "tls: unknown certificate", "tls: unknown certificate authority"}
+
+// rejected tells whether the client aborted the handshake with an alert
+// rejecting the certificate, rather than for any other reason such as a
+// protocol mismatch, a closed connection or a timeout.
+func rejected(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "remote error" && slices.Contains(rejectAlerts, oe.Err.Error())
+}
+
+// Skipped tells whether the host was learned to be skipped.
+func (l *LearnedSkip) Skipped(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.hosts[strings.ToLower(host)]
+	return h != nil && h.Status == LearnedSkipped
+}
+
+// Hosts returns the learned hosts, the most recently failing first.
+func (l *LearnedSkip) Hosts() []*LearnedHost {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hosts := make([]*LearnedHost, 0, len(l.hosts))
+	for _, h := range l.hosts {
+		c := *h
+		hosts = append(hosts, &c)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].LastFailure.After(hosts[j].LastFailure) })
+	return hosts
+}
+
+// SetStatus promotes a host to be skipped, or demotes it, ignoring it or
+// making it a candidate again.
+func (l *LearnedSkip) SetStatus(host, status string) (*LearnedHost, error) {
+	switch status {
+	case LearnedCandidate, LearnedSkipped, LearnedIgnored:
+	default:
+		return nil, errors.New("unknown status " + status)
+	}
+	host = strings.ToLower(host)
+	if host == "" {
+		return nil, errors.New("no host given")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.hosts[host]
+	if h == nil {
+		h = &LearnedHost{Host: host}
+		l.hosts[host] = h
+	}
+	h.Status = status
+	l.save()
+	c := *h
+	return &c, nil
+}
+
+func (l *LearnedSkip) save() {
+	hosts := make([]*LearnedHost, 0, len(l.hosts))
+	for _, h := range l.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	b, err := json.MarshalIndent(hosts, "", "  ")
+	if err == nil {
+		// replaced at once, not to lose the hosts on a crash
+		tmp := l.path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, l.path)
+		}
+	}
+	if err != nil {
+		log.Error("unable to save the learned hosts", "path", l.path, "err", err)
+	}
+}
@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"shawnma.com/clarity/ca"
+	"shawnma.com/clarity/config"
+)
+
+func TestLearnedSkip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "learned.json")
+	c := config.PinningConfig{Threshold: 2, Window: time.Minute}
+	l, err := NewLearnedSkip(c, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert := &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}
+
+	// a client not trusting the CA rejects everything
+	l.HandshakeDone("10.0.0.2:1234", "pinned.com", alert)
+	l.HandshakeDone("10.0.0.2:1234", "pinned.com", alert)
+	if len(l.Hosts()) != 0 {
+		t.Fatalf("Clients not trusting the CA must be ignored")
+	}
+
+	l.HandshakeDone("10.0.0.1:1234", "example.com", nil)
+	l.HandshakeDone("10.0.0.1:1235", "pinned.com", alert)
+	l.HandshakeDone("10.0.0.1:1236", "pinned.com", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded})
+	l.HandshakeDone("10.0.0.1:1236", "pinned.com", io.EOF)
+	l.HandshakeDone("10.0.0.1:1236", "pinned.com", &net.OpError{Op: "remote error", Err: errors.New("tls: protocol version not supported")})
+	if len(l.Hosts()) != 0 {
+		t.Fatalf("Only the rejections of the certificate must be counted")
+	}
+	l.HandshakeDone("10.0.0.1:1237", "Pinned.com", handshakeError(t))
+	hosts := l.Hosts()
+	if len(hosts) != 1 || hosts[0].Host != "pinned.com" || hosts[0].Status != LearnedCandidate || l.Skipped("pinned.com") {
+		t.Fatalf("Expected pinned.com as a candidate, got %+v", hosts)
+	}
+
+	if _, err := l.SetStatus("pinned.com", LearnedSkipped); err != nil {
+		t.Fatal(err)
+	}
+	// kept across restarts
+	l, err = NewLearnedSkip(c, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Skipped("pinned.com") {
+		t.Errorf("pinned.com must be skipped once promoted")
+	}
+
+	c.AutoSkip = true
+	l, _ = NewLearnedSkip(c, filepath.Join(t.TempDir(), "auto.json"))
+	l.HandshakeDone("10.0.0.1:1234", "example.com", nil)
+	l.HandshakeDone("10.0.0.1:1234", "auto.com", alert)
+	l.HandshakeDone("10.0.0.1:1234", "auto.com", alert)
+	if !l.Skipped("auto.com") {
+		t.Errorf("auto.com must be skipped right away")
+	}
+}
+
+func TestLearnedPromoteAdminOnly(t *testing.T) {
+	l, err := NewLearnedSkip(config.PinningConfig{Threshold: 1, Window: time.Minute}, filepath.Join(t.TempDir(), "learned.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFilter(&config.Config{}, nil)
+	f.SetLearnedSkip(l)
+	tests := []struct {
+		method, remote, xff string
+		code                int
+	}{
+		{"GET", "127.0.0.1:1234", "", http.StatusMethodNotAllowed},
+		{"POST", "192.168.1.20:1234", "", http.StatusForbidden},
+		// forwarded by the proxy for a client
+		{"POST", "127.0.0.1:1234", "192.168.1.20", http.StatusForbidden},
+		{"POST", "[::1]:1234", "", http.StatusOK},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, "/config/learned/promote?host=pinned.com", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		w := httptest.NewRecorder()
+		f.HttpHandler().ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%s from %s for %q: expected %d, got %d", tc.method, tc.remote, tc.xff, tc.code, w.Code)
+		}
+		if skipped := l.Skipped("pinned.com"); skipped != (tc.code == http.StatusOK) {
+			t.Errorf("%s from %s for %q: pinned.com skipped %v", tc.method, tc.remote, tc.xff, skipped)
+		}
+	}
+}
+
+// handshakeError returns the error of the server when the client doesn't
+// trust its certificate.
+func handshakeError(t *testing.T) error {
+	a, err := ca.Generate("Test CA", "Clarity", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ca.NewCertCache(a, t.TempDir(), 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	go tls.Client(c, &tls.Config{ServerName: "pinned.com"}).Handshake()
+	err = tls.Server(s, certs.TLS()).Handshake()
+	c.Close()
+	return err
+}
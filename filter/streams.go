@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3"
+	"shawnma.com/clarity/metrics"
+)
+
+// entryKey holds the policy entry which allowed a request in its context.
+const entryKey = "filter.entry"
+
+// How often the streams are checked against their entries. It's below the
+// session gap, for an open stream to count as activity in the quotas.
+const streamCheckInterval = 30 * time.Second
+
+var (
+	openStreams = metrics.NewGaugeVec("clarity_streams_active",
+		"Long lived streams open, per policy.", "policy")
+	terminatedStreams = metrics.NewCounterVec("clarity_streams_terminated_total",
+		"Streams closed at the end of the allowance of their policy.", "policy")
+)
+
+// stream is a long lived connection allowed by a policy entry, which the
+// filter doesn't see any request of: a WebSocket or a streamed response.
+type stream struct {
+	closer io.Closer
+	client string
+	url    string
+}
+
+type streams struct {
+	mu sync.Mutex
+	m  map[*Entry]map[*stream]bool
+}
+
+// track registers the stream allowed by the entry, until untracked.
+func (f *Filter) track(e *Entry, s *stream) (untrack func()) {
+	f.streams.mu.Lock()
+	defer f.streams.mu.Unlock()
+	if f.streams.m == nil {
+		f.streams.m = map[*Entry]map[*stream]bool{}
+	}
+	if f.streams.m[e] == nil {
+		f.streams.m[e] = map[*stream]bool{}
+		// to be accounted from the next check
+		f.wakeScheduler()
+	}
+	f.streams.m[e][s] = true
+	openStreams.Inc(e.Policy.Path)
+	return func() {
+		f.streams.mu.Lock()
+		defer f.streams.mu.Unlock()
+		if f.streams.m[e][s] {
+			delete(f.streams.m[e], s)
+			openStreams.Dec(e.Policy.Path)
+		}
+		if len(f.streams.m[e]) == 0 {
+			delete(f.streams.m, e)
+		}
+	}
+}
+
+// checkStreams accounts the open streams as activity, closing those of the
+// entries which don't allow them anymore.
+func (f *Filter) checkStreams(now time.Time) {
+	f.streams.mu.Lock()
+	var expired []*stream
+	for e, ss := range f.streams.m {
+		// the streams were active until now
+		f.recordUsage(e, now)
+		if f.allows(e, now) {
+			continue
+		}
+		for s := range ss {
+			log.Info("closing stream", "client", s.client, "url", s.url, "policy", e.Policy.Path)
+			terminatedStreams.Inc(e.Policy.Path)
+			openStreams.Dec(e.Policy.Path)
+			expired = append(expired, s)
+		}
+		delete(f.streams.m, e)
+	}
+	f.streams.mu.Unlock()
+	for _, s := range expired {
+		s.closer.Close()
+	}
+}
+
+// ModifyResponse relays the WebSockets, and tracks them and the streamed
+// responses allowed by a policy, for them to end with its allowance.
+func (f *Filter) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil {
+		return nil
+	}
+	var e *Entry
+	if v, ok := ctx.Get(entryKey); ok {
+		e = v.(*Entry)
+	}
+	s := &stream{client: res.Request.RemoteAddr, url: res.Request.URL.String()}
+	if rwc, ok := res.Body.(io.ReadWriteCloser); ok && res.StatusCode == http.StatusSwitchingProtocols {
+		return f.relay(ctx, res, rwc, e, s)
+	}
+	if e == nil || !streamed(res) {
+		return nil
+	}
+	s.closer = res.Body
+	res.Body = &streamBody{ReadCloser: res.Body, untrack: f.track(e, s)}
+	return nil
+}
+
+// streamed tells whether the response is an open ended stream: events, or
+// live audio or video.
+func streamed(res *http.Response) bool {
+	if res.ContentLength >= 0 {
+		return false
+	}
+	ct, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return ct == "text/event-stream" || strings.HasPrefix(ct, "video/") || strings.HasPrefix(ct, "audio/")
+}
+
+// relay copies the upgraded connection to and from the client, as the proxy
+// only relays what the server sends. It returns once either side closes.
+func (f *Filter) relay(ctx *martian.Context, res *http.Response, rwc io.ReadWriteCloser, e *Entry, s *stream) error {
+	defer rwc.Close()
+	conn, brw, err := ctx.Session().Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		return err
+	}
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+	if e != nil {
+		s.closer = conn
+		defer f.track(e, s)()
+	}
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(rwc, brw.Reader)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, rwc)
+		errc <- err
+	}()
+	<-errc
+	// unblocks the other copy
+	conn.Close()
+	rwc.Close()
+	<-errc
+	return nil
+}
+
+// streamBody untracks the stream once the response is over.
+type streamBody struct {
+	io.ReadCloser
+	untrack func()
+}
+
+func (b *streamBody) Close() error {
+	b.untrack()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,120 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"shawnma.com/clarity/config"
+)
+
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCheckStreams(t *testing.T) {
+	f := NewFilter(&config.Config{SessionGap: time.Minute}, nil)
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	quota := &Entry{Policy: config.Policy{Path: "youtube.com", MaxAllowed: time.Minute}}
+	expiry := now.Add(2 * time.Minute)
+	temporary := &Entry{Policy: config.Policy{Path: "aops.com"}, ExpireTime: &expiry}
+	q, tmp := &closer{}, &closer{}
+	f.track(quota, &stream{closer: q})
+	untrack := f.track(temporary, &stream{closer: tmp})
+
+	f.checkStreams(now)
+	if q.closed || tmp.closed {
+		t.Fatal("Expected the streams to stay open")
+	}
+	// the open stream is accounted until the quota is over
+	f.checkStreams(now.Add(30 * time.Second))
+	f.checkStreams(now.Add(61 * time.Second))
+	if !q.closed {
+		t.Errorf("Expected the stream to be closed at the end of the quota, used %s", quota.UsedDuration)
+	}
+	if tmp.closed {
+		t.Error("Expected the stream to stay open until the expiry")
+	}
+	untrack()
+	if len(f.streams.m) != 0 {
+		t.Errorf("Expected no stream left, got %v", f.streams.m)
+	}
+}
+
+func TestStreamed(t *testing.T) {
+	tests := []struct {
+		contentType string
+		length      int64
+		streamed    bool
+	}{
+		{"text/event-stream", -1, true},
+		{"video/mp2t", -1, true},
+		{"audio/mpeg", -1, true},
+		{"video/mp4", 1024, false},
+		{"text/html; charset=utf-8", -1, false},
+	}
+	for _, tc := range tests {
+		res := &http.Response{Header: http.Header{"Content-Type": {tc.contentType}}, ContentLength: tc.length}
+		if got := streamed(res); got != tc.streamed {
+			t.Errorf("%s, %d: expected %v, got %v", tc.contentType, tc.length, tc.streamed, got)
+		}
+	}
+}
+
+func TestRelayWebSocket(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		io.Copy(c, brw)
+	}))
+	defer upstream.Close()
+
+	p := martian.NewProxy()
+	defer p.Close()
+	f := NewFilter(&config.Config{}, nil)
+	p.SetRequestModifier(f)
+	p.SetResponseModifier(f)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", upstream.URL, upstream.Listener.Addr())
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the protocol switched, got %s", res.Status)
+	}
+	// the client talks first, which the proxy doesn't relay by itself
+	c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "hello" {
+		t.Errorf("Expected the echo, got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,201 @@
+package intercept
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/google/martian/v3"
+)
+
+// The proxy only speaks HTTP/1.1, and tells the intercepted requests by their
+// connection being TLS. The streams of an HTTP/2 connection are forwarded to
+// it over plain in-memory connections, as requests of their own, marked with
+// a header only the interceptor knows, so that ModifyRequest has the proxy
+// treat them as secure and the modifiers see them as any other.
+
+// streamHeader carries the secret of the interceptor on the requests of the
+// HTTP/2 streams.
+const streamHeader = "X-Clarity-Stream"
+
+// EnableHTTP2 offers HTTP/2 to the clients of the intercepted connections.
+func (i *Interceptor) EnableHTTP2() {
+	i.h2 = true
+}
+
+// serveH2 serves the HTTP/2 connection c, returning once it's closed.
+func (i *Interceptor) serveH2(c *tls.Conn) {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return i.dialProxy(ctx, c.RemoteAddr())
+		},
+		// the response goes back as the proxy sends it
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 100,
+	}
+	defer tr.CloseIdleConnections()
+
+	l := &connListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	l.conns <- c
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i.forward(tr, w, r)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+		ErrorLog: slog.NewLogLogger(log.Handler(), slog.LevelDebug),
+	}
+	srv.Serve(l)
+}
+
+// dialProxy connects to the proxy in memory as the client.
+func (i *Interceptor) dialProxy(ctx context.Context, client net.Addr) (net.Conn, error) {
+	cc, sc := net.Pipe()
+	select {
+	case i.conns <- &addrConn{sc, client}:
+		return cc, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-i.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// ModifyRequest has the proxy treat the requests of the HTTP/2 streams as
+// secure, as it does the ones over TLS. It goes before the modifiers looking
+// at the scheme of the requests.
+func (i *Interceptor) ModifyRequest(req *http.Request) error {
+	if req.Header.Get(streamHeader) != i.secret {
+		return nil
+	}
+	req.Header.Del(streamHeader)
+	req.URL.Scheme = "https"
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.Session().MarkSecure()
+	}
+	return nil
+}
+
+// forward sends the request through the proxy, and its response back.
+func (i *Interceptor) forward(tr *http.Transport, w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Scheme = "http"
+	out.URL.Host = r.Host
+	out.Header.Set(streamHeader, i.secret)
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+	res, err := tr.RoundTrip(out)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Debug("forwarding HTTP/2 request failed", "url", out.URL.String(), "err", err)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	h := w.Header()
+	for k, v := range res.Header {
+		switch k {
+		// connection specific headers are not allowed in HTTP/2
+		case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+			continue
+		}
+		h[k] = v
+	}
+	for k := range res.Trailer {
+		h.Add("Trailer", k)
+	}
+	w.WriteHeader(res.StatusCode)
+	copyFlush(w, res.Body)
+	for k, v := range res.Trailer {
+		h[k] = v
+	}
+}
+
+// HTTP1 returns the round tripper answering the clients of the proxy in
+// HTTP/1.1 with the responses rt gets over HTTP/2. The proxy writes the
+// responses as they come, and would otherwise send HTTP/2.0 ones and close the
+// connection after those of unknown length.
+func HTTP1(rt http.RoundTripper) http.RoundTripper {
+	return &http1RoundTripper{rt}
+}
+
+type http1RoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t *http1RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.rt.RoundTrip(req)
+	if err != nil || res.ProtoMajor < 2 {
+		return res, err
+	}
+	res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.1", 1, 1
+	if res.ContentLength < 0 && len(res.TransferEncoding) == 0 && req.Method != http.MethodHead &&
+		res.StatusCode >= 200 && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotModified {
+		res.TransferEncoding = []string{"chunked"}
+	}
+	return res, nil
+}
+
+// copyFlush copies the body as it comes, for the streamed responses.
+func copyFlush(w http.ResponseWriter, body io.Reader) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// addrConn is a connection from another address, the one of the client.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// connListener serves the connections passed to it until closed.
+type connListener struct {
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
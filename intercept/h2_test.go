@@ -0,0 +1,139 @@
+package intercept
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/mitm"
+	"shawnma.com/clarity/ca"
+)
+
+func TestHTTP2(t *testing.T) {
+	a, err := ca.Generate("Test CA", "Test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ca.NewCertCache(a, t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := New(certs, &net.TCPAddr{})
+	i.EnableHTTP2()
+	defer i.Close()
+	// stands for the proxy, which gets HTTP/1.1 over TLS
+	go (&http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Proto", r.Proto)
+		io.WriteString(w, r.Host+" "+r.RemoteAddr+" "+string(body))
+	})}).Serve(i)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Cert)
+	tr := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go i.ServeStream(server, "example.com", 443, policy{})
+			tc := tls.Client(client, &tls.Config{ServerName: "example.com", RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+			return tc, tc.Handshake()
+		},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+	res, err := (&http.Client{Transport: tr}).Post("https://example.com/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 with the client, got %s", res.Proto)
+	}
+	if p := res.Header.Get("X-Proto"); p != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 with the proxy, got %s", p)
+	}
+	// net.Pipe addresses are "pipe"
+	if string(body) != "example.com pipe hello" {
+		t.Errorf("Unexpected response %q", body)
+	}
+}
+
+func TestHTTP2Upstream(t *testing.T) {
+	a, err := ca.Generate("Test CA", "Test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ca.NewCertCache(a, t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// streams the response, of unknown length
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+		w.(http.Flusher).Flush()
+	}))
+	up.EnableHTTP2 = true
+	up.StartTLS()
+	defer up.Close()
+
+	i := New(certs, &net.TCPAddr{})
+	i.EnableHTTP2()
+	defer i.Close()
+	mc, err := mitm.NewConfig(a.Cert, a.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := martian.NewProxy()
+	p.SetMITM(mc)
+	p.SetRoundTripper(HTTP1(up.Client().Transport))
+	p.SetRequestModifier(i)
+	p.SetResponseModifier(i)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go p.Serve(l)
+	go p.Serve(i)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Cert)
+	proxy := http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()})
+	for _, h2 := range []bool{false, true} {
+		tr := &http.Transport{Proxy: proxy, TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: h2}
+		reused := false
+		for n := 0; n < 2; n++ {
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+			// the body never ends when the proxy means to close the connection
+			ctx, cancel := context.WithTimeout(httptrace.WithClientTrace(context.Background(), trace), 5*time.Second)
+			req, _ := http.NewRequestWithContext(ctx, "GET", up.URL, nil)
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			cancel()
+			if string(body) != "HTTP/2.0" {
+				t.Errorf("Expected HTTP/2 with the server, got %q", body)
+			}
+			if want := map[bool]int{false: 1, true: 2}[h2]; res.ProtoMajor != want || res.Close {
+				t.Errorf("Expected a persistent HTTP/%d connection with the client, got %s, close %v", want, res.Proto, res.Close)
+			}
+		}
+		if !reused {
+			t.Errorf("Expected the connection to be reused, h2 %v", h2)
+		}
+		tr.CloseIdleConnections()
+	}
+}
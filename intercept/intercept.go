@@ -0,0 +1,217 @@
+// Package intercept takes over the CONNECT tunnels the proxy decided to MITM,
+// terminating TLS with the certificates of the cache and handing the
+// decrypted connections back to the proxy.
+package intercept
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3"
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/ca"
+	"shawnma.com/clarity/logging"
+	"shawnma.com/clarity/metrics"
+)
+
+var (
+	log         = applog.For("mitm")
+	activeConns = metrics.NewGaugeVec("clarity_mitm_connections_active",
+		"Intercepted connections currently open.")
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// Interceptor is a response modifier for the CONNECT requests, a request
+// modifier for the streams of the HTTP/2 connections, and the listener the
+// proxy serves the intercepted connections from.
+type Interceptor struct {
+	certs  *ca.CertCache
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+	addr   net.Addr
+	// told of the outcome of the handshakes, if set
+	onHandshake func(client, host string, err error)
+	// logs the spliced connections, if set
+	access logging.AccessLogger
+	// whether HTTP/2 is offered to the clients
+	h2 bool
+	// connects the spliced connections to their destination, directly if nil
+	dial func(network, addr string) (net.Conn, error)
+	// resolves the server names of the spliced connections, net.LookupHost if nil
+	lookup func(host string) ([]string, error)
+	// tells the requests of the HTTP/2 streams
+	secret string
+}
+
+func New(certs *ca.CertCache, addr net.Addr) *Interceptor {
+	return &Interceptor{certs: certs, conns: make(chan net.Conn), closed: make(chan struct{}), addr: addr, secret: secret()}
+}
+
+// secret returns the random value the HTTP/2 streams are told apart by.
+func secret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SetHandshakeCallback sets the function told about the handshakes in which
+// the clients were presented the certificates of the intercepted hosts, with
+// a nil error on success.
+func (i *Interceptor) SetHandshakeCallback(cb func(client, host string, err error)) {
+	i.onHandshake = cb
+}
+
+// SetAccessLogger sets the logger of the connections spliced to their
+// destination, which the proxy never sees.
+func (i *Interceptor) SetAccessLogger(l logging.AccessLogger) {
+	i.access = l
+}
+
+// SetDialer sets how the spliced connections reach their destination, such
+// as through an upstream proxy.
+func (i *Interceptor) SetDialer(dial func(network, addr string) (net.Conn, error)) {
+	i.dial = dial
+}
+
+// ModifyResponse hijacks the tunnels established by the MITM proxy. It only
+// returns once the intercepted connection is closed, as the proxy does when
+// it handles the connection itself.
+func (i *Interceptor) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req.Method != "CONNECT" || res.StatusCode != http.StatusOK {
+		return nil
+	}
+	session := martian.NewContext(req).Session()
+	if session.IsSkippingMitm() || session.Hijacked() {
+		return nil
+	}
+	conn, brw, err := session.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := res.Write(brw); err != nil {
+		return err
+	}
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+
+	b, err := brw.Peek(1)
+	if err != nil {
+		return nil // the client gave up
+	}
+	// the proxy tells TLS connections by their type, so the notification of
+	// the close goes under the TLS layer
+	done := make(chan struct{})
+	var c net.Conn = &closeNotifyConn{Conn: &bufferedConn{conn, brw.Reader}, done: done}
+	// 22 is the TLS handshake, anything else goes through in plain text
+	if b[0] == 22 {
+		tc, err := i.terminate(c, req.RemoteAddr, req.URL.Hostname())
+		if err != nil {
+			return nil
+		}
+		c = tc
+	}
+	i.serve(c, done)
+	return nil
+}
+
+// terminate completes the TLS handshake with the certificate of the host,
+// unless the client asks for another one, telling the callback how it went.
+func (i *Interceptor) terminate(c net.Conn, client, host string) (*tls.Conn, error) {
+	config := i.certs.TLSForHost(host)
+	if i.h2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	presented := false
+	getCertificate := config.GetCertificate
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+		presented = err == nil
+		return cert, err
+	}
+	tc := tls.Server(c, config)
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := tc.Handshake()
+	if i.onHandshake != nil && presented {
+		i.onHandshake(client, host, err)
+	}
+	if err != nil {
+		log.Debug("handshake failed", "host", host, "client", client, "err", err)
+		c.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// serve hands the connection over to the proxy, returning once it's closed.
+func (i *Interceptor) serve(c net.Conn, done chan struct{}) {
+	if tc, ok := c.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == "h2" {
+		activeConns.Inc()
+		i.serveH2(tc)
+		activeConns.Dec()
+		return
+	}
+	select {
+	case i.conns <- c:
+	case <-i.closed:
+		c.Close()
+		return
+	}
+	activeConns.Inc()
+	<-done
+	activeConns.Dec()
+}
+
+// Accept returns the next intercepted connection.
+func (i *Interceptor) Accept() (net.Conn, error) {
+	select {
+	case c := <-i.conns:
+		return c, nil
+	case <-i.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (i *Interceptor) Close() error {
+	i.once.Do(func() { close(i.closed) })
+	return nil
+}
+
+func (i *Interceptor) Addr() net.Addr {
+	return i.addr
+}
+
+// bufferedConn reads what was buffered before the connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
@@ -0,0 +1,282 @@
+package intercept
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"shawnma.com/clarity/logging"
+	"shawnma.com/clarity/transparent"
+)
+
+// Policy decides on the connections which come without a CONNECT request, as
+// filter.Filter does.
+type Policy interface {
+	// Skipped tells whether the traffic of the host is not intercepted
+	Skipped(host, path string) bool
+	// AllowTunnel tells whether the client may reach the host at addr without
+	// interception
+	AllowTunnel(client, host, addr string) bool
+}
+
+const dialTimeout = 10 * time.Second
+
+// Time the client is given to speak first. The protocols in which the server
+// does are spliced after it.
+const peekTimeout = time.Second
+
+var errHelloRead = errors.New("client hello read")
+
+// methods are the starts of the HTTP requests, told from the other streams.
+var methods = []string{"GET ", "POST", "PUT ", "HEAD", "DELE", "OPTI", "PATC", "TRAC"}
+
+// ServeTransparent accepts the TLS connections redirected to l, deciding on
+// each one from its client and host, i.e. the SNI of its ClientHello or the IP
+// of its original destination, before any handshake happens. It returns when l
+// fails.
+func (i *Interceptor) ServeTransparent(l net.Listener, dsts *transparent.Destinations, p Policy) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			var host, addr string
+			if dst := dsts.Lookup(c.RemoteAddr().String()); dst != nil {
+				host, addr = dst.IP.String(), dst.String()
+			}
+			i.handleTLS(c, host, addr, p)
+		}()
+	}
+}
+
+// ServeStream handles a connection to host:port made through another kind of
+// proxy. TLS is handled like on the transparent listener, intercepted if it
+// carries HTTP, HTTP is handed to the proxy and anything else is spliced to
+// its destination if the policy allows it. It returns once the connection is handed over or closed.
+func (i *Interceptor) ServeStream(c net.Conn, host string, port int, p Policy) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(peekTimeout))
+	b, err := br.Peek(len(methods[0]))
+	c.SetReadDeadline(time.Time{})
+	var nerr net.Error
+	if len(b) == 0 && !(errors.As(err, &nerr) && nerr.Timeout()) {
+		c.Close() // the client gave up
+		return
+	}
+	replay := &bufferedConn{c, br}
+	switch {
+	// 22 is the TLS handshake
+	case len(b) > 0 && b[0] == 22:
+		i.handleTLS(replay, host, addr, p)
+	case isHTTP(b):
+		done := make(chan struct{})
+		i.serve(&closeNotifyConn{Conn: replay, done: done}, done)
+	default:
+		client := c.RemoteAddr().String()
+		if !p.AllowTunnel(client, host, addr) {
+			c.Close()
+			return
+		}
+		i.splice(replay, client, addr)
+	}
+}
+
+func isHTTP(b []byte) bool {
+	for _, m := range methods {
+		if string(b) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// handleTLS intercepts the TLS connection c or splices it to addr, depending
+// on its host: the server name of its ClientHello, host without one. A
+// server name not resolving to addr is refused rather than spliced.
+func (i *Interceptor) handleTLS(c net.Conn, host, addr string, p Policy) {
+	client := c.RemoteAddr().String()
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	hello, sni, protos, err := peekClientHello(c)
+	if err != nil {
+		log.Debug("no client hello", "client", client, "err", err)
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	if sni != "" {
+		host = sni
+	}
+	if host == "" {
+		log.Debug("no host for the connection", "client", client)
+		c.Close()
+		return
+	}
+	if addr == "" {
+		addr = net.JoinHostPort(host, "443")
+	}
+	// the ClientHello is replayed to whoever handles the connection
+	replay := &bufferedConn{c, io.MultiReader(bytes.NewReader(hello), c)}
+
+	if !p.Skipped(host, "") && isWeb(addr, protos) {
+		done := make(chan struct{})
+		tc, err := i.terminate(&closeNotifyConn{Conn: replay, done: done}, client, host)
+		if err != nil {
+			return
+		}
+		i.serve(tc, done)
+		return
+	}
+	// the decision on the server name must hold for the destination dialed
+	if !p.AllowTunnel(client, host, addr) || !i.resolvesTo(host, addr) {
+		c.Close()
+		return
+	}
+	i.splice(replay, client, addr)
+}
+
+// resolvesTo tells whether host is the host of addr or resolves to its IP, so
+// a client can't name an allowed host while connecting to another one.
+func (i *Interceptor) resolvesTo(host, addr string) bool {
+	dst, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, dst) {
+		return true
+	}
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		log.Info("server name not matching the destination", "host", host, "addr", addr)
+		return false
+	}
+	lookup := i.lookup
+	if lookup == nil {
+		lookup = net.LookupHost
+	}
+	ips, err := lookup(host)
+	if err != nil {
+		log.Info("unable to resolve the server name", "host", host, "err", err)
+		return false
+	}
+	for _, a := range ips {
+		if ip.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	log.Info("server name not resolving to the destination", "host", host, "addr", addr)
+	return false
+}
+
+// isWeb tells whether the TLS connection to addr carries HTTP, which the
+// proxy can intercept: on the HTTPS port or offering HTTP with ALPN. Other
+// protocols, such as IMAPS or XMPP, are only spliced.
+func isWeb(addr string, protos []string) bool {
+	if _, port, _ := net.SplitHostPort(addr); port == "443" {
+		return true
+	}
+	return slices.ContainsFunc(protos, func(p string) bool { return p == "h2" || p == "http/1.1" })
+}
+
+// peekClientHello reads the ClientHello of c, returning its bytes, the server
+// name and the ALPN protocols it asks for, if any.
+func peekClientHello(c net.Conn) ([]byte, string, []string, error) {
+	var buf bytes.Buffer
+	var sni string
+	var protos []string
+	read := false
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni, protos, read = hello.ServerName, hello.SupportedProtos, true
+			return nil, errHelloRead
+		},
+	}
+	err := tls.Server(readOnlyConn{io.TeeReader(c, &buf), c}, config).Handshake()
+	if !read {
+		return nil, "", nil, err
+	}
+	return buf.Bytes(), sni, protos, nil
+}
+
+func (i *Interceptor) dialUpstream(addr string) (net.Conn, error) {
+	if i.dial != nil {
+		return i.dial("tcp", addr)
+	}
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+// splice copies the connection to and from addr until either side closes,
+// logging it then.
+func (i *Interceptor) splice(c net.Conn, client, addr string) {
+	defer c.Close()
+	h := &logging.HttpLog{
+		Time:       time.Now(),
+		RemoteAddr: client,
+		Method:     "CONNECT",
+		Url:        addr,
+		Class:      logging.ClassTunnel,
+	}
+	up, err := i.dialUpstream(addr)
+	if err != nil {
+		log.Info("unable to reach the spliced host", "addr", addr, "err", err)
+		h.ResponseCode = http.StatusBadGateway
+		i.logSplice(h)
+		return
+	}
+	defer up.Close()
+	h.ResponseCode = http.StatusOK
+	h.UpstreamIP, _, _ = net.SplitHostPort(up.RemoteAddr().String())
+	log.Debug("splicing", "client", client, "addr", addr)
+	var sent, received atomic.Int64
+	errc := make(chan error, 2)
+	go func() {
+		n, err := io.Copy(up, c)
+		sent.Store(n)
+		errc <- err
+	}()
+	go func() {
+		n, err := io.Copy(c, up)
+		received.Store(n)
+		errc <- err
+	}()
+	<-errc
+	// unblocks the other copy
+	c.Close()
+	up.Close()
+	<-errc
+	h.RequestBytes, h.ResponseBytes = sent.Load(), received.Load()
+	h.Duration = time.Since(h.Time)
+	i.logSplice(h)
+}
+
+func (i *Interceptor) logSplice(h *logging.HttpLog) {
+	logging.CountRequest(h)
+	if i.access != nil {
+		i.access.Log(h)
+	}
+}
+
+// readOnlyConn reads from r and writes nothing, so an aborted handshake
+// leaves no trace on the connection.
+type readOnlyConn struct {
+	r io.Reader
+	net.Conn
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,202 @@
+package intercept
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"shawnma.com/clarity/ca"
+	"shawnma.com/clarity/logging"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	for _, sni := range []string{"example.com", ""} {
+		client, server := net.Pipe()
+		go func() {
+			tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+		}()
+		hello, got, _, err := peekClientHello(server)
+		client.Close()
+		if err != nil {
+			t.Fatalf("%q: %s", sni, err)
+		}
+		if got != sni {
+			t.Errorf("Expected server name %q, got %q", sni, got)
+		}
+		// the bytes are enough for a handshake to start over
+		_, again, _, err := peekClientHello(readOnlyConn{bytes.NewReader(hello), server})
+		if err != nil || again != sni {
+			t.Errorf("%q: unable to replay the hello, got %q, %v", sni, again, err)
+		}
+	}
+}
+
+func TestPeekNotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		client.Close()
+	}()
+	if _, _, _, err := peekClientHello(server); err == nil {
+		t.Error("Expected an error for plain HTTP")
+	}
+}
+
+type policy struct {
+	skipped, allowed bool
+}
+
+func (p policy) Skipped(host, path string) bool             { return p.skipped }
+func (p policy) AllowTunnel(client, host, addr string) bool { return p.allowed }
+
+type memLogger struct {
+	logs chan *logging.HttpLog
+}
+
+func (l memLogger) Log(h *logging.HttpLog)           { l.logs <- h }
+func (l memLogger) LogSearch(e *logging.SearchEvent) {}
+
+func TestServeStreamSplice(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	addr := echo.Addr().(*net.TCPAddr)
+
+	for _, allowed := range []bool{true, false} {
+		i := New(nil, nil)
+		l := memLogger{make(chan *logging.HttpLog, 1)}
+		i.SetAccessLogger(l)
+		client, server := net.Pipe()
+		go i.ServeStream(server, "127.0.0.1", addr.Port, policy{allowed: allowed})
+		client.Write([]byte("\x00hello"))
+		b := make([]byte, 6)
+		_, err := io.ReadFull(client, b)
+		client.Close()
+		if !allowed {
+			if err == nil {
+				t.Error("Expected the stream to be closed")
+			}
+			continue
+		}
+		if string(b) != "\x00hello" {
+			t.Errorf("Expected the echo, got %q, %v", b, err)
+		}
+		h := <-l.logs
+		if h.Url != addr.String() || h.RequestBytes != 6 || h.ResponseBytes != 6 {
+			t.Errorf("Expected 6 bytes each way to %s, got %+v", addr, h)
+		}
+	}
+}
+
+func TestIsWeb(t *testing.T) {
+	tests := []struct {
+		addr   string
+		protos []string
+		web    bool
+	}{
+		{"example.com:443", nil, true},
+		{"example.com:8443", []string{"h2", "http/1.1"}, true},
+		{"example.com:8443", []string{"http/1.1"}, true},
+		{"imap.example.com:993", nil, false},
+		{"chat.example.com:5223", []string{"xmpp-client"}, false},
+	}
+	for _, tc := range tests {
+		if got := isWeb(tc.addr, tc.protos); got != tc.web {
+			t.Errorf("%s %v: expected %v, got %v", tc.addr, tc.protos, tc.web, got)
+		}
+	}
+}
+
+func TestResolvesTo(t *testing.T) {
+	i := New(nil, nil)
+	i.lookup = func(host string) ([]string, error) {
+		if host == "allowed.example.com" {
+			return []string{"192.0.2.1", "2001:db8::1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	tests := []struct {
+		host, addr string
+		ok         bool
+	}{
+		{"192.0.2.9", "192.0.2.9:443", true},
+		{"imap.example.com", "IMAP.example.com:993", true},
+		{"allowed.example.com", "192.0.2.1:443", true},
+		{"allowed.example.com", "[2001:db8::1]:443", true},
+		// an allowed name on a connection to another server
+		{"allowed.example.com", "198.51.100.7:443", false},
+		{"allowed.example.com", "blocked.example.com:443", false},
+		{"unknown.example.com", "192.0.2.1:443", false},
+	}
+	for _, tc := range tests {
+		if got := i.resolvesTo(tc.host, tc.addr); got != tc.ok {
+			t.Errorf("%s to %s: expected %v, got %v", tc.host, tc.addr, tc.ok, got)
+		}
+	}
+}
+
+func TestServeStreamSpliceTLS(t *testing.T) {
+	// the server has its own CA, which the interception would replace
+	a, err := ca.Generate("Server CA", "Test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ca.NewCertCache(a, t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", certs.TLSForHost("imap.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	mitm, err := ca.Generate("Test CA", "Test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mitmCerts, err := ca.NewCertCache(mitm, t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := New(mitmCerts, &net.TCPAddr{})
+	defer i.Close()
+	// the name resolves to the test server
+	i.SetDialer(func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, l.Addr().String())
+	})
+	client, server := net.Pipe()
+	go i.ServeStream(server, "imap.example.com", l.Addr().(*net.TCPAddr).Port, policy{allowed: true})
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Cert)
+	tc := tls.Client(client, &tls.Config{ServerName: "imap.example.com", RootCAs: roots})
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tc.Write([]byte("a001 CAPABILITY")); err != nil {
+		t.Fatalf("Expected the connection spliced to the server: %s", err)
+	}
+	b := make([]byte, 15)
+	if _, err := io.ReadFull(tc, b); err != nil || string(b) != "a001 CAPABILITY" {
+		t.Errorf("Expected the echo, got %q, %v", b, err)
+	}
+}
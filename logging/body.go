@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"shawnma.com/clarity/config"
+)
+
+const (
+	defaultMaxRequestBody  = 16 * 1024
+	defaultMaxResponseBody = 4 * 1024
+	// How much of a request is kept to look for a search query
+	searchScanLimit = 16 * 1024
+)
+
+var defaultBodyTypes = []string{"text/*", "*json", "application/x-www-form-urlencoded"}
+
+// bodyPolicy decides which bodies are captured and how much of them.
+type bodyPolicy struct {
+	store       bool
+	maxRequest  int
+	maxResponse int
+	allow       []string
+	deny        []string
+}
+
+func newBodyPolicy(c config.BodyConfig) *bodyPolicy {
+	p := &bodyPolicy{
+		store:       !c.Disabled,
+		maxRequest:  c.MaxRequest,
+		maxResponse: c.MaxResponse,
+		allow:       c.Allow,
+		deny:        c.Deny,
+	}
+	if p.maxRequest == 0 {
+		p.maxRequest = defaultMaxRequestBody
+	}
+	if p.maxResponse == 0 {
+		p.maxResponse = defaultMaxResponseBody
+	}
+	if len(p.allow) == 0 {
+		p.allow = defaultBodyTypes
+	}
+	return p
+}
+
+// storable tells if bodies of the content type are kept in the log.
+func (p *bodyPolicy) storable(ct string) bool {
+	if !p.store || ct == "" {
+		return false
+	}
+	for _, d := range p.deny {
+		if matchContentType(d, ct) {
+			return false
+		}
+	}
+	for _, a := range p.allow {
+		if matchContentType(a, ct) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchContentType matches a content type against a pattern which may start
+// or end with a * wildcard, e.g. text/* or *json.
+func matchContentType(pattern, ct string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(ct, pattern[:len(pattern)-1])
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(ct, pattern[1:])
+	}
+	return pattern == ct
+}
+
+// capture keeps a copy of the first max bytes of a body while it streams
+// through to its destination, and calls done once the body is consumed or
+// closed. Everything read is also written to tee, if set.
+type capture struct {
+	io.ReadCloser
+	max int
+	// the request body is read by the transport while its response is
+	// handled, mu guards buf against the reads going on
+	mu  sync.Mutex
+	buf bytes.Buffer
+	tee io.Writer
+	// bytes read in total
+	n    int64
+	once sync.Once
+	done func(c *capture)
+}
+
+func newCapture(body io.ReadCloser, max int, done func(c *capture)) *capture {
+	return &capture{ReadCloser: body, max: max, done: done}
+}
+
+func (c *capture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	if c.tee != nil && n > 0 {
+		c.tee.Write(p[:n])
+	}
+	c.mu.Lock()
+	if room := c.max - c.buf.Len(); room > 0 && n > 0 {
+		if room > n {
+			room = n
+		}
+		c.buf.Write(p[:room])
+	}
+	c.mu.Unlock()
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *capture) Close() error {
+	err := c.ReadCloser.Close()
+	c.finish()
+	return err
+}
+
+func (c *capture) finish() {
+	c.once.Do(func() {
+		if c.done != nil {
+			c.done(c)
+		}
+	})
+}
+
+// Total returns the number of bytes read so far.
+func (c *capture) Total() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Bytes returns a copy of what was captured so far.
+func (c *capture) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.buf.Bytes())
+}
+
+// decodePrefix decompresses as much as possible of a possibly truncated body
+// with the given content encoding, up to max bytes.
+func decodePrefix(encoding string, b []byte, max int) []byte {
+	var r io.Reader
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return b
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil
+		}
+		r = gr
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(b))
+	default:
+		return nil
+	}
+	// a truncated body ends with an unexpected EOF, keep what was decoded;
+	// a few compressed bytes may inflate to far more than is kept
+	d, _ := io.ReadAll(io.LimitReader(r, int64(max)))
+	return d
+}
+
+// truncate cuts s to at most max bytes without splitting a UTF-8 sequence.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	// drops the partial sequence at the end, if any
+	return strings.ToValidUTF8(s[:max], "")
+}
@@ -0,0 +1,148 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"shawnma.com/clarity/config"
+)
+
+func TestBodyPolicy(t *testing.T) {
+	tests := []struct {
+		c    config.BodyConfig
+		ct   string
+		want bool
+	}{
+		{config.BodyConfig{}, "text/html", true},
+		{config.BodyConfig{}, "application/json", true},
+		{config.BodyConfig{}, "application/x-www-form-urlencoded", true},
+		{config.BodyConfig{}, "image/png", false},
+		{config.BodyConfig{}, "", false},
+		{config.BodyConfig{Disabled: true}, "text/html", false},
+		{config.BodyConfig{Deny: []string{"text/html"}}, "text/html", false},
+		{config.BodyConfig{Deny: []string{"text/html"}}, "text/plain", true},
+		{config.BodyConfig{Allow: []string{"*"}, Deny: []string{"image/*"}}, "application/octet-stream", true},
+	}
+	for _, tc := range tests {
+		if got := newBodyPolicy(tc.c).storable(tc.ct); got != tc.want {
+			t.Errorf("%+v with %s: expected %t, got %t", tc.c, tc.ct, tc.want, got)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	done := 0
+	c := newCapture(io.NopCloser(strings.NewReader("hello world")), 5, func(c *capture) { done++ })
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "hello world" {
+		t.Fatalf("The body must stream through unchanged, got %s %v", b, err)
+	}
+	c.Close()
+	if string(c.Bytes()) != "hello" || done != 1 || c.Total() != 11 {
+		t.Errorf("Expected hello captured once out of 11 bytes, got %s %d times out of %d", c.Bytes(), done, c.Total())
+	}
+}
+
+func TestLogCountsUpload(t *testing.T) {
+	m := &memLogger{}
+	l := NewLogger(&config.Config{}, m)
+	req, _ := http.NewRequest("PUT", "https://example.com/upload", strings.NewReader(strings.Repeat("x", 1000)))
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+	if err := l.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	// the server answers early, the upload goes on
+	req.Body.Read(make([]byte, 100))
+	res := &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok")), Request: req}
+	if err := l.ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(req.Body)
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	if len(m.logs) != 1 || m.logs[0].RequestBytes != 1000 || m.logs[0].ResponseBytes != 2 {
+		t.Errorf("Expected 1000 bytes sent and 2 received, got %+v", m.logs)
+	}
+}
+
+func TestLogUploadAfterResponse(t *testing.T) {
+	// the server answers before reading the upload, which goes on while the
+	// response is logged
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).EnableFullDuplex()
+		w.Write([]byte("ok"))
+		w.(http.Flusher).Flush()
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer s.Close()
+	m := &memLogger{}
+	l := NewLogger(&config.Config{}, m)
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", s.URL, pr)
+	req.Header.Set("Content-Type", "text/plain")
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+	if err := l.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go func() {
+		defer pw.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				pw.Write([]byte("x"))
+			}
+		}
+	}()
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	if len(m.logs) != 1 || m.logs[0].ResponseBytes != 2 || !strings.HasPrefix(m.logs[0].RequestBody, "x") {
+		t.Errorf("Expected the upload and 2 bytes received logged, got %+v", m.logs)
+	}
+}
+
+func TestDecodePrefix(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(strings.Repeat("<title>Clarity</title>", 1000)))
+	w.Close()
+	// truncated compressed body still decodes to a prefix
+	d := decodePrefix("gzip", buf.Bytes()[:buf.Len()/2], 1<<20)
+	if !strings.HasPrefix(string(d), "<title>Clarity</title>") {
+		t.Errorf("Unable to decode the prefix: %.30s", d)
+	}
+	// no more is inflated than is kept
+	if d := decodePrefix("gzip", buf.Bytes(), 100); len(d) != 100 {
+		t.Errorf("Expected 100 bytes decoded, got %d", len(d))
+	}
+	if decodePrefix("br", buf.Bytes(), 1<<20) != nil {
+		t.Errorf("Unsupported encoding must not decode")
+	}
+	if s := truncate("日本", 4); s != "日" {
+		t.Errorf("Wrong truncation: %s", s)
+	}
+}
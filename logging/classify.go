@@ -0,0 +1,190 @@
+package logging
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"shawnma.com/clarity/util"
+)
+
+// Request classes, so that a page visit can be told apart from the hundreds
+// of requests it triggers.
+const (
+	// ClassPage is a top level navigation
+	ClassPage = "page"
+	// ClassXHR is a fetch or XMLHttpRequest made by a page
+	ClassXHR = "xhr"
+	// ClassMedia is audio or video, including streaming playlists and segments
+	ClassMedia = "media"
+	// ClassAsset is a script, style sheet, image, font or frame
+	ClassAsset = "asset"
+	// ClassTelemetry is an analytics beacon, ping or report
+	ClassTelemetry = "telemetry"
+	// ClassTunnel is a CONNECT request
+	ClassTunnel = "tunnel"
+	// ClassDns is a query made to the built in DNS server
+	ClassDns = "dns"
+	// ClassOther is anything the request and response don't tell enough about
+	ClassOther = "other"
+)
+
+var classes = util.Set[string]{}
+
+// Path segments commonly used by analytics endpoints
+var telemetrySegments = util.Set[string]{}
+
+func init() {
+	for _, c := range []string{ClassPage, ClassXHR, ClassMedia, ClassAsset, ClassTelemetry, ClassTunnel, ClassDns, ClassOther} {
+		classes.Add(c)
+	}
+	for _, s := range []string{"log", "logs", "collect", "beacon", "ping", "track", "tracking", "analytics",
+		"telemetry", "metrics", "stats", "events", "pixel", "gen_204", "generate_204", "csi"} {
+		telemetrySegments.Add(s)
+	}
+}
+
+var fetchDestClass = map[string]string{
+	"document":      ClassPage,
+	"empty":         ClassXHR,
+	"audio":         ClassMedia,
+	"video":         ClassMedia,
+	"track":         ClassMedia,
+	"embed":         ClassMedia,
+	"object":        ClassMedia,
+	"iframe":        ClassAsset,
+	"frame":         ClassAsset,
+	"image":         ClassAsset,
+	"style":         ClassAsset,
+	"script":        ClassAsset,
+	"font":          ClassAsset,
+	"manifest":      ClassAsset,
+	"worker":        ClassAsset,
+	"sharedworker":  ClassAsset,
+	"serviceworker": ClassAsset,
+	"xslt":          ClassAsset,
+	"report":        ClassTelemetry,
+	"websocket":     ClassXHR,
+}
+
+var extensionClass = map[string]string{
+	".js":    ClassAsset,
+	".mjs":   ClassAsset,
+	".css":   ClassAsset,
+	".png":   ClassAsset,
+	".jpg":   ClassAsset,
+	".jpeg":  ClassAsset,
+	".gif":   ClassAsset,
+	".webp":  ClassAsset,
+	".avif":  ClassAsset,
+	".svg":   ClassAsset,
+	".ico":   ClassAsset,
+	".woff":  ClassAsset,
+	".woff2": ClassAsset,
+	".ttf":   ClassAsset,
+	".mp4":   ClassMedia,
+	".webm":  ClassMedia,
+	".m3u8":  ClassMedia,
+	".mpd":   ClassMedia,
+	".ts":    ClassMedia,
+	".m4s":   ClassMedia,
+	".mp3":   ClassMedia,
+	".aac":   ClassMedia,
+	".m4a":   ClassMedia,
+}
+
+// classifier tells the class of a request from its headers and URL.
+type classifier struct {
+	// configured telemetry hosts/paths, on top of the built in heuristics
+	telemetry util.UrlMatch[bool]
+}
+
+func newClassifier(telemetry []string) *classifier {
+	c := &classifier{}
+	for _, t := range telemetry {
+		c.telemetry.Add(t, true)
+	}
+	return c
+}
+
+// validateClasses makes sure the configured classes exist.
+func validateClasses(cs []string) error {
+	for _, c := range cs {
+		if !classes.Has(c) {
+			return fmt.Errorf("unknown request class: %s", c)
+		}
+	}
+	return nil
+}
+
+func (c *classifier) classify(req *http.Request) string {
+	if req.Method == "CONNECT" {
+		return ClassTunnel
+	}
+	dest := req.Header.Get("Sec-Fetch-Dest")
+	// navigations win over the telemetry heuristics, e.g. a page at /events
+	if dest != "document" && c.isTelemetry(req) {
+		return ClassTelemetry
+	}
+	if dest != "" {
+		if class, ok := fetchDestClass[dest]; ok {
+			return class
+		}
+		return ClassOther
+	}
+	// Clients not sending fetch metadata, e.g. apps and older browsers
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return ClassXHR
+	}
+	if class, ok := extensionClass[strings.ToLower(path.Ext(req.URL.Path))]; ok {
+		return class
+	}
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/html"):
+		return ClassPage
+	case strings.HasPrefix(accept, "image/"), strings.HasPrefix(accept, "text/css"):
+		return ClassAsset
+	case strings.HasPrefix(accept, "video/"), strings.HasPrefix(accept, "audio/"):
+		return ClassMedia
+	case strings.HasPrefix(accept, "application/json"):
+		return ClassXHR
+	}
+	return ClassOther
+}
+
+func (c *classifier) isTelemetry(req *http.Request) bool {
+	if req.Header.Get("Ping-To") != "" || req.Header.Get("Ping-From") != "" ||
+		sanitizeContentType(req.Header.Get("Content-Type")) == "text/ping" {
+		return true
+	}
+	if c.telemetry.Match(req.URL.Hostname(), req.URL.Path) {
+		return true
+	}
+	// only the last segment, e.g. /youtubei/v1/log_event is not but /log is
+	last := strings.ToLower(path.Base(req.URL.Path))
+	return telemetrySegments.Has(last)
+}
+
+// refineClass uses the response content type for requests the request alone
+// could not classify.
+func refineClass(class string, res *http.Response) string {
+	if class != ClassOther {
+		return class
+	}
+	ct := sanitizeContentType(res.Header.Get("Content-Type"))
+	switch {
+	case ct == "text/html":
+		return ClassPage
+	case strings.HasPrefix(ct, "image/"), strings.HasPrefix(ct, "font/"), ct == "text/css",
+		strings.HasSuffix(ct, "javascript"):
+		return ClassAsset
+	case strings.HasPrefix(ct, "video/"), strings.HasPrefix(ct, "audio/"), strings.Contains(ct, "mpegurl"),
+		ct == "application/dash+xml":
+		return ClassMedia
+	case strings.HasSuffix(ct, "json"), strings.HasSuffix(ct, "xml"):
+		return ClassXHR
+	}
+	return class
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers map[string]string
+		class   string
+	}{
+		{"connect", "CONNECT", "http://youtube.com:443", nil, ClassTunnel},
+		{"navigation", "GET", "https://youtube.com/events", map[string]string{"Sec-Fetch-Dest": "document"}, ClassPage},
+		{"fetch", "GET", "https://youtube.com/youtubei/v1/next", map[string]string{"Sec-Fetch-Dest": "empty"}, ClassXHR},
+		{"beacon", "POST", "https://play.google.com/log", map[string]string{"Sec-Fetch-Dest": "empty"}, ClassTelemetry},
+		{"configured telemetry", "POST", "https://stats.g.doubleclick.net/j/x", nil, ClassTelemetry},
+		{"hyperlink ping", "POST", "https://example.com/click", map[string]string{"Ping-To": "https://x.com"}, ClassTelemetry},
+		{"video", "GET", "https://rr1.googlevideo.com/videoplayback", map[string]string{"Sec-Fetch-Dest": "video"}, ClassMedia},
+		{"image", "GET", "https://i.ytimg.com/vi/1", map[string]string{"Sec-Fetch-Dest": "image"}, ClassAsset},
+		{"app script", "GET", "https://cdn.example.com/app.JS", nil, ClassAsset},
+		{"app segment", "GET", "https://cdn.example.com/seg-1.m4s", nil, ClassMedia},
+		{"old browser", "GET", "https://example.com/", map[string]string{"Accept": "text/html,application/xhtml+xml"}, ClassPage},
+		{"app api", "GET", "https://example.com/api", map[string]string{"Accept": "application/json"}, ClassXHR},
+		{"unknown", "GET", "https://example.com/api", nil, ClassOther},
+	}
+	c := newClassifier([]string{"doubleclick.net"})
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		if class := c.classify(req); class != tc.class {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.class, class)
+		}
+	}
+}
+
+func TestRefineClass(t *testing.T) {
+	tests := []struct {
+		class string
+		ct    string
+		want  string
+	}{
+		{ClassOther, "text/html; charset=utf-8", ClassPage},
+		{ClassOther, "application/vnd.apple.mpegurl", ClassMedia},
+		{ClassOther, "application/json", ClassXHR},
+		{ClassOther, "application/octet-stream", ClassOther},
+		{ClassXHR, "text/html", ClassXHR},
+	}
+	for _, tc := range tests {
+		res := &http.Response{Header: http.Header{"Content-Type": []string{tc.ct}}}
+		if got := refineClass(tc.class, res); got != tc.want {
+			t.Errorf("%s with %s: expected %s, got %s", tc.class, tc.ct, tc.want, got)
+		}
+	}
+}
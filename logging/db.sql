@@ -2,7 +2,8 @@ CREATE database clarity;
 
 CREATE TABLE if not exists LOG (
     Id bigint(20) NOT NULL AUTO_INCREMENT,
-    RemoteAddr varchar(32),
+    RemoteAddr varchar(64),
+    ClientIP varchar(64),
     Method varchar(10),
     RequestContentType varchar(50),
     RequestLength int,
@@ -12,10 +13,53 @@ CREATE TABLE if not exists LOG (
     ResponseLength int,
     ResponseBody Text,
     Title varchar(400),
+    OgTitle varchar(400),
+    Description varchar(1000),
+    Canonical varchar(1024),
+    Language varchar(32),
+    Class varchar(16),
+    Policy varchar(1024),
+    Decision varchar(16),
     URL varchar(1024),
     LogTime datetime NOT NULL,
-    primary key(Id, LogTime)
-) ENGINE = InnoDB DEFAULT CHARSET = utf8
+    RequestBytes bigint,
+    ResponseBytes bigint,
+    TtfbMs int,
+    DurationMs int,
+    UpstreamIP varchar(64),
+    RequestId varchar(32),
+    primary key(Id, LogTime),
+    index LogTimeIdx (LogTime),
+    index ClientIdx (ClientIP, LogTime)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4
+
+CREATE TABLE if not exists SEARCH (
+    Id bigint(20) NOT NULL AUTO_INCREMENT,
+    Client varchar(64),
+    Engine varchar(32),
+    Query varchar(1024),
+    URL varchar(1024),
+    LogTime datetime NOT NULL,
+    primary key(Id),
+    index LogTimeIdx (LogTime)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4
+
+-- Upgrading a database created by an earlier version: the proxy refuses to
+-- start until the tables have all their columns, run the statements adding
+-- the missing ones.
+ALTER TABLE LOG ADD INDEX LogTimeIdx (LogTime);
+ALTER TABLE LOG ADD COLUMN Policy varchar(1024) AFTER Title, ADD COLUMN Decision varchar(16) AFTER Policy;
+ALTER TABLE LOG ADD COLUMN Class varchar(16) AFTER Title;
+ALTER TABLE LOG CONVERT TO CHARACTER SET utf8mb4;
+ALTER TABLE LOG ADD COLUMN OgTitle varchar(400) AFTER Title, ADD COLUMN Description varchar(1000) AFTER OgTitle,
+    ADD COLUMN Canonical varchar(1024) AFTER Description, ADD COLUMN Language varchar(32) AFTER Canonical;
+ALTER TABLE LOG ADD COLUMN RequestBytes bigint, ADD COLUMN ResponseBytes bigint, ADD COLUMN TtfbMs int,
+    ADD COLUMN DurationMs int, ADD COLUMN UpstreamIP varchar(64);
+ALTER TABLE LOG ADD COLUMN RequestId varchar(32);
+ALTER TABLE LOG MODIFY RemoteAddr varchar(64), ADD COLUMN ClientIP varchar(64) AFTER RemoteAddr,
+    ADD INDEX ClientIdx (ClientIP, LogTime);
+UPDATE LOG SET ClientIP = TRIM(BOTH '[]' FROM LEFT(RemoteAddr, LENGTH(RemoteAddr) - LOCATE(':', REVERSE(RemoteAddr))))
+    WHERE ClientIP IS NULL AND RemoteAddr LIKE '%:%';
 
 CREATE USER shawn identified by 'xxx';
 grant all privileges on clarity.* to shawn;
\ No newline at end of file
@@ -0,0 +1,174 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// HistoryQuery selects access log rows. Empty fields are not filtered on.
+type HistoryQuery struct {
+	// Client IP, without the port
+	Client string
+	// Host suffix, e.g. youtube.com also matches www.youtube.com
+	Host string
+	From time.Time
+	To   time.Time
+	// Request class, see the Class constants
+	Class string
+	// Free text searched in both title and URL
+	Text string
+	// Rows older than the cursor, from the Next of the previous page, if set
+	Before *Cursor
+	Size   int
+}
+
+// Cursor is the position of a row, the rows being ordered by time then id,
+// from which the next page goes on.
+type Cursor struct {
+	Time time.Time
+	Id   int64
+}
+
+func (c Cursor) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "%d_%d", c.Time.UnixNano(), c.Id), nil
+}
+
+func (c *Cursor) UnmarshalText(b []byte) error {
+	t, id, ok := strings.Cut(string(b), "_")
+	ns, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || !ok {
+		return fmt.Errorf("invalid cursor: %s", b)
+	}
+	if c.Id, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return fmt.Errorf("invalid cursor: %s", b)
+	}
+	c.Time = time.Unix(0, ns)
+	return nil
+}
+
+type HistoryPage struct {
+	// Entries matching the query, only counted for the first page
+	Total int
+	Size  int
+	Items []*HttpLog
+	// Cursor of the next page, nil on the last one
+	Next *Cursor
+}
+
+type SearchPage struct {
+	// Events matching the query, only counted for the first page
+	Total int
+	Size  int
+	Items []*SearchEvent
+	Next  *Cursor
+}
+
+// Querier is implemented by access loggers which are able to read back what
+// they have logged.
+type Querier interface {
+	Query(q *HistoryQuery) (*HistoryPage, error)
+	Searches(q *HistoryQuery) (*SearchPage, error)
+	Clients() ([]string, error)
+}
+
+// NewHistoryQuery parses the query parameters of a history API request.
+func NewHistoryQuery(req *http.Request) (*HistoryQuery, error) {
+	v := req.URL.Query()
+	q := &HistoryQuery{
+		Client: v.Get("client"),
+		Host:   strings.TrimPrefix(v.Get("host"), "*."),
+		Class:  v.Get("class"),
+		Text:   v.Get("q"),
+		Size:   defaultPageSize,
+	}
+	if q.Class != "" {
+		if err := validateClasses([]string{q.Class}); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if q.From, err = parseTime(v.Get("from")); err != nil {
+		return nil, fmt.Errorf("invalid from time: %s", err)
+	}
+	if q.To, err = parseTime(v.Get("to")); err != nil {
+		return nil, fmt.Errorf("invalid to time: %s", err)
+	}
+	if b := v.Get("before"); b != "" {
+		q.Before = &Cursor{}
+		if err := q.Before.UnmarshalText([]byte(b)); err != nil {
+			return nil, err
+		}
+	}
+	if s := v.Get("size"); s != "" {
+		if q.Size, err = strconv.Atoi(s); err != nil || q.Size <= 0 {
+			return nil, fmt.Errorf("invalid page size: %s", s)
+		}
+		if q.Size > maxPageSize {
+			q.Size = maxPageSize
+		}
+	}
+	return q, nil
+}
+
+// parseTime accepts either RFC3339 or a local date/datetime as typed into a
+// browser date picker.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time format: %s", s)
+}
+
+type historyError struct {
+	Result  bool
+	Message string
+}
+
+// NewHistoryHandler serves /config/history for browsing the access log,
+// /config/history/searches for the search events and /config/history/clients
+// for listing known clients.
+func NewHistoryHandler(q Querier) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		var result any
+		var err error
+		switch req.URL.Path {
+		case "/config/history":
+			var hq *HistoryQuery
+			if hq, err = NewHistoryQuery(req); err == nil {
+				result, err = q.Query(hq)
+			}
+		case "/config/history/searches":
+			var hq *HistoryQuery
+			if hq, err = NewHistoryQuery(req); err == nil {
+				result, err = q.Searches(hq)
+			}
+		case "/config/history/clients":
+			result, err = q.Clients()
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			apiLog.Warn("history request failed", "path", req.URL.Path, "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			result = historyError{false, err.Error()}
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+	return http.HandlerFunc(fn)
+}
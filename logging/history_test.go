@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryQuery(t *testing.T) {
+	tests := []struct {
+		url   string
+		where string
+		args  int
+		err   string
+	}{{
+		"/config/history",
+		"",
+		0,
+		"",
+	}, {
+		"/config/history?client=10.1.1.5&q=math",
+		" WHERE ClientIP = ? AND (Title LIKE ? OR URL LIKE ?)",
+		3,
+		"",
+	}, {
+		"/config/history?host=youtube.com&from=2023-05-01&to=2023-05-02T10:00",
+		"LogTime >= ? AND LogTime < ?",
+		8,
+		"",
+	}, {
+		"/config/history?from=yesterday",
+		"",
+		0,
+		"invalid from time",
+	}, {
+		"/config/history?before=yesterday",
+		"",
+		0,
+		"invalid cursor",
+	}}
+	for _, tc := range tests {
+		q, err := NewHistoryQuery(httptest.NewRequest("GET", tc.url, nil))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error %s, got: %v", tc.url, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", tc.url, err)
+		}
+		where, args := historyWhere(q)
+		if !strings.Contains(where, tc.where) || len(args) != tc.args {
+			t.Errorf("%s: expected %q with %d args, got %q with %d", tc.url, tc.where, tc.args, where, len(args))
+		}
+	}
+}
+
+func TestHistoryCursor(t *testing.T) {
+	c := Cursor{time.Date(2023, 5, 1, 20, 0, 0, 0, time.Local), 42}
+	b, _ := c.MarshalText()
+	q, err := NewHistoryQuery(httptest.NewRequest("GET", "/config/history?class=page&before="+string(b), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.Before.Time.Equal(c.Time) || q.Before.Id != c.Id {
+		t.Errorf("Expected %v, got %v", c, q.Before)
+	}
+	where, args := historyWhere(q)
+	where, args = before(where, args, q.Before)
+	if where != " WHERE Class = ? AND (LogTime < ? OR (LogTime = ? AND Id < ?))" || len(args) != 4 {
+		t.Errorf("Unexpected keyset condition %q with %d args", where, len(args))
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	if e := escapeLike(`50%_off\`); e != `50\%\_off\\` {
+		t.Errorf("Wrong escape: %s", e)
+	}
+}
+
+func TestMissingColumns(t *testing.T) {
+	have := []string{"Id", "Client", "engine", "Query", "LogTime"}
+	got := missingColumns("SEARCH", schema[1].columns, have)
+	if strings.Join(got, ",") != "SEARCH.URL" {
+		t.Errorf("Expected SEARCH.URL missing, got %v", got)
+	}
+	if got := missingColumns("LOG", schema[0].columns, nil); len(got) != len(schema[0].columns) {
+		t.Errorf("Expected every column of a missing table, got %v", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for addr, ip := range map[string]string{
+		"10.1.1.5:5000":      "10.1.1.5",
+		"[2001:db8::1]:5000": "2001:db8::1",
+		"10.1.1.5":           "10.1.1.5",
+	} {
+		if got := (&HttpLog{RemoteAddr: addr}).ClientIP(); got != ip {
+			t.Errorf("%s: expected %s, got %s", addr, ip, got)
+		}
+	}
+}
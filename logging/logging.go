@@ -3,20 +3,29 @@ package logging
 import (
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/martian/v3"
-	"github.com/google/martian/v3/messageview"
+	"shawnma.com/clarity/applog"
 	"shawnma.com/clarity/config"
 	"shawnma.com/clarity/util"
 )
 
+var (
+	log    = applog.For("logging")
+	apiLog = applog.For("api")
+)
+
 type HttpLog struct {
+	Id int64
+	// Correlates the entry with the logs of the request in the subsystems
+	RequestId  string
+	Time       time.Time
 	User       string
 	RemoteAddr string
 	Method     string
@@ -31,51 +40,139 @@ type HttpLog struct {
 	ResponseLength      int
 	ResponseBody        string
 	Title               string
+	// Bytes actually transferred, whatever the headers say
+	RequestBytes  int64
+	ResponseBytes int64
+	// From the start of the request to the first byte of the response
+	// from upstream, and to the end of the response
+	TTFB     time.Duration
+	Duration time.Duration
+	// Address of the upstream server the request was sent to
+	UpstreamIP string
+
+	// Metadata from the head of HTML pages
+	OgTitle     string
+	Description string
+	Canonical   string
+	Language    string
+
+	// One of the Class constants
+	Class string
+	// Path of the policy governing the request, if any
+	Policy string
+	// Set by the filter for requests it acted on, see the Decision constants
+	Decision string
+}
+
+const (
+	// DecisionBlocked is a request to a completely blocked site
+	DecisionBlocked = "blocked"
+	// DecisionDenied is a request denied by a policy
+	DecisionDenied = "denied"
+	// DecisionExtended is a request for temporary allowance of a policy
+	DecisionExtended = "extended"
+)
+
+// ClientIP is the IP of the client, RemoteAddr without the port.
+func (l *HttpLog) ClientIP() string {
+	if host, _, err := net.SplitHostPort(l.RemoteAddr); err == nil {
+		return host
+	}
+	return l.RemoteAddr
 }
 
 func (l *HttpLog) String() string {
-	return fmt.Sprintf("[%s | %s][%s | %d | %s][%d | %s | %d | %s | %s] %s",
+	return fmt.Sprintf("[%s | %s][%s | %d | %s][%d | %s | %d | %s | %s][%s | %s | %s] %s",
 		l.RemoteAddr, l.Method,
 		l.RequestContentType, l.RequestLength, l.RequestBody,
 		l.ResponseCode, l.ResponseContentType, l.ResponseLength, l.ResponseBody, l.Title,
-		l.Url)
+		l.Class, l.Policy, l.Decision, l.Url)
 }
 
-var titleExp = regexp.MustCompile(`(?i)<title>([^<>]*)</title>`)
+// FromContext returns the log entry the logger attached to the request, so
+// later modifiers can annotate it.
+func FromContext(ctx *martian.Context) *HttpLog {
+	if l, ok := ctx.Get("log"); ok {
+		return l.(*HttpLog)
+	}
+	return nil
+}
 
 type AccessLogger interface {
 	Log(httpLog *HttpLog)
+	LogSearch(e *SearchEvent)
+}
+
+type classFilter struct {
+	AccessLogger
+	classes util.Set[string]
+}
+
+// NewClassFilter returns an access logger passing on the entries of the
+// classes the config logs, as the response logger does, and those the filter
+// decided on.
+func NewClassFilter(c *config.Config, l AccessLogger) AccessLogger {
+	if len(c.Logs.Classes) == 0 {
+		return l
+	}
+	classes := util.Set[string]{}
+	for _, k := range c.Logs.Classes {
+		classes.Add(k)
+	}
+	return &classFilter{l, classes}
+}
+
+func (f *classFilter) Log(h *HttpLog) {
+	if h.Decision != "" || f.classes.Has(h.Class) {
+		f.AccessLogger.Log(h)
+	}
 }
 
 // logger is a modifier that logs requests and responses.
 type logger struct {
 	log          AccessLogger
 	skippedPaths util.UrlMatch[bool]
+	classifier   *classifier
+	search       *searchExtractor
+	redact       *redactor
+	body         *bodyPolicy
+	// classes to log, all if empty
+	classes util.Set[string]
 }
 
-// NewLogger returns a logger that logs requests and responses, optionally
-// logging the body. Log function defaults to martian.Infof.
-func NewLogger(c *config.Config) martian.RequestResponseModifier {
-	l, e := NewAccessLogger(c)
-	if e != nil {
-		log.Fatalf("Unable to create access logger: %s", e)
-	}
+// NewLogger returns a logger that logs requests and responses to the given
+// access logger, optionally logging the body.
+func NewLogger(c *config.Config, l AccessLogger) martian.RequestResponseModifier {
 	var s util.UrlMatch[bool]
 	for _, k := range c.Logs.SkipLogging {
 		s.Add(k, true)
 	}
-	return &logger{l, s}
+	if err := validateClasses(c.Logs.Classes); err != nil {
+		applog.Fatal(log, "invalid logs config", "err", err)
+	}
+	classes := util.Set[string]{}
+	for _, k := range c.Logs.Classes {
+		classes.Add(k)
+	}
+	search, err := newSearchExtractor(c.Logs.SearchEngines)
+	if err != nil {
+		applog.Fatal(log, "invalid logs config", "err", err)
+	}
+	return &logger{l, s, newClassifier(c.Logs.Telemetry), search, newRedactor(c.Logs.Redact), newBodyPolicy(c.Logs.Body), classes}
 }
 
-// ModifyRequest simply put all the request header and body into the context for later use
+// ModifyRequest puts the request headers into the context for later use, and
+// starts capturing the body if it is to be logged.
 func (l *logger) ModifyRequest(req *http.Request) error {
 	ctx := martian.NewContext(req)
 	if l.shouldSkip(req.URL) {
-		// log.Printf("Skipped logging for %s", req.URL)
 		ctx.SkipLogging()
 		return nil
 	}
 	var httpLog HttpLog
+	httpLog.Time = time.Now()
+	httpLog.RequestId = ctx.ID()
+	httpLog.Class = l.classifier.classify(req)
 
 	ct := sanitizeContentType(req.Header.Get("Content-Type"))
 	httpLog.RequestContentType = ct
@@ -85,60 +182,75 @@ func (l *logger) ModifyRequest(req *http.Request) error {
 			httpLog.RequestLength = l
 		}
 	}
-	httpLog.Url = req.URL.String()
+	httpLog.Url = l.redact.url(req.URL)
 	if len(httpLog.Url) > 1000 {
 		httpLog.Url = httpLog.Url[:1000]
 	}
 	httpLog.Method = req.Method
 	httpLog.RemoteAddr = req.RemoteAddr
 
-	skipBody := true
-	if strings.HasPrefix(ct, "text") || strings.HasSuffix(ct, "json") || strings.HasSuffix(ct, "x-www-form-urlencoded") {
-		skipBody = false
+	ctx.Set("log", &httpLog)
+
+	if req.Method == "CONNECT" {
+		return nil
 	}
-	mv := messageview.New()
-	mv.SkipBody(skipBody)
-	if err := mv.SnapshotRequest(req); err != nil {
-		return err
+	// The body is captured while the request streams upstream, it is read
+	// once the response comes back.
+	max := 0
+	if l.body.storable(ct) {
+		max = l.body.maxRequest
 	}
-
-	if !skipBody {
-		b, err := l.readBody(mv)
-		if err != nil {
-			return err
-		}
-		httpLog.RequestBody = b
+	if l.search.matches(req) && max < searchScanLimit {
+		max = searchScanLimit
+	}
+	// the body is always wrapped to count the bytes sent upstream
+	if req.Body != nil && req.Body != http.NoBody {
+		body := newCapture(req.Body, max, nil)
+		req.Body = body
+		ctx.Set("log.body", body)
+	} else {
+		max = 0
+	}
+	if max == 0 {
+		l.logSearch(req, ct, "")
 	}
-
-	ctx.Set("log", &httpLog)
 	return nil
 }
 
-func (*logger) readBody(mv *messageview.MessageView) (string, error) {
-	opts := []messageview.Option{messageview.Decode()}
-	r, err := mv.BodyReader(opts...)
-	if err != nil {
-		return "", err
+func (l *logger) logSearch(req *http.Request, ct, body string) {
+	if e := l.search.extract(req, ct, body); e != nil {
+		e.Url = l.redact.url(req.URL)
+		l.log.LogSearch(e)
 	}
-	b, e := io.ReadAll(r)
-	if e != nil {
-		return "", e
-	}
-	return string(b), nil
 }
 
-// ModifyResponse logs the response, optionally including the body.
+// ModifyResponse logs the response, optionally including the body. When the
+// body is needed the log is written once it has streamed to the client.
 func (l *logger) ModifyResponse(res *http.Response) error {
 	ctx := martian.NewContext(res.Request)
 	if ctx.SkippingLogging() {
 		return nil
 	}
 
-	httpLog, ok := ctx.Get("log")
-	if !ok {
+	h := FromContext(ctx)
+	if h == nil {
 		return fmt.Errorf("unable to find log object in request for %s", res.Request.URL)
 	}
-	h := httpLog.(*HttpLog)
+
+	var upload *capture
+	if v, ok := ctx.Get("log.body"); ok {
+		c := v.(*capture)
+		upload = c
+		if c.max > 0 {
+			b := string(decodePrefix(res.Request.Header.Get("Content-Encoding"), c.Bytes(), c.max))
+			l.logSearch(res.Request, h.RequestContentType, b)
+			if l.body.storable(h.RequestContentType) {
+				// nothing sensitive is kept past this point, redacted before
+				// being cut to size for a field not to lose its name
+				h.RequestBody = truncate(l.redact.body(h.RequestContentType, b), l.body.maxRequest)
+			}
+		}
+	}
 
 	ct := sanitizeContentType(res.Header.Get("Content-Type"))
 	h.ResponseCode = res.StatusCode
@@ -148,35 +260,64 @@ func (l *logger) ModifyResponse(res *http.Response) error {
 		if l, e := strconv.Atoi(length); e == nil {
 			h.ResponseLength = l
 		} else {
-			log.Printf("unable to parse length %s: %s\n", length, e)
+			log.Warn("unable to parse response length", "request", h.RequestId, "length", length, "err", e)
 		}
 	}
+	h.Class = refineClass(h.Class, res)
+	CountRequest(h)
+	if len(l.classes) > 0 && !l.classes.Has(h.Class) {
+		return nil
+	}
 
-	skipBody := true
-	if strings.HasPrefix(ct, "text") || strings.HasSuffix(ct, "json") {
-		skipBody = false
+	// the upload may go on past the response, its bytes are counted when the
+	// log is written
+	write := func() {
+		if upload != nil {
+			h.RequestBytes = upload.Total()
+		}
+		h.Duration = time.Since(h.Time)
+		l.log.Log(h)
 	}
-	mv := messageview.New()
-	mv.SkipBody(skipBody)
-	if err := mv.SnapshotResponse(res); err != nil {
-		return err
+	if rwc, ok := res.Body.(io.ReadWriteCloser); ok && res.StatusCode == http.StatusSwitchingProtocols {
+		// logged with its duration once over
+		res.Body = newUpgraded(rwc, func(read, written int64) {
+			h.RequestBytes, h.ResponseBytes = written, read
+			h.Duration = time.Since(h.Time)
+			l.log.Log(h)
+		})
+		return nil
 	}
-	if !skipBody {
-		b, err := l.readBody(mv)
-		if err != nil {
-			return err
-		}
-		r := []rune(b)
-		if len(r) > 1000 {
-			r = r[:1000]
+	if res.Request.Method == "CONNECT" || res.Body == nil || res.Body == http.NoBody {
+		write()
+		return nil
+	}
+	// The response is always wrapped to count the bytes sent to the client,
+	// and logged once it is over.
+	store := l.body.storable(ct)
+	html := ct == "text/html" || ct == "application/xhtml+xml"
+	max := 0
+	if store {
+		max = l.body.maxResponse
+	}
+	encoding := res.Header.Get("Content-Encoding")
+	var meta *metaExtractor
+	body := newCapture(res.Body, max, func(c *capture) {
+		h.ResponseBytes = c.Total()
+		if meta != nil {
+			m := meta.finish()
+			h.Title, h.OgTitle, h.Description, h.Canonical, h.Language = m.Title, m.OgTitle, m.Description, m.Canonical, m.Language
 		}
-		b = string(r)
-		match := titleExp.FindStringSubmatch(b)
-		if len(match) > 1 {
-			h.Title = match[1]
+		if store {
+			b := string(decodePrefix(encoding, c.Bytes(), l.body.maxResponse))
+			h.ResponseBody = truncate(l.redact.body(ct, b), l.body.maxResponse)
 		}
+		write()
+	})
+	if html {
+		meta = newMetaExtractor(res.Header.Get("Content-Type"), encoding)
+		body.tee = meta
 	}
-	l.log.Log(h)
+	res.Body = body
 	return nil
 }
 
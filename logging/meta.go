@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// How much of an HTML response is kept, and then decoded, looking for the end
+// of the head.
+const headScanLimit = 512 * 1024
+
+// pageMeta is the metadata found in the head of an HTML page.
+type pageMeta struct {
+	Title       string
+	OgTitle     string
+	Description string
+	Canonical   string
+	Language    string
+}
+
+// metaExtractor keeps the start of an HTML response while it streams through
+// to the client, and tokenizes it once the response is over. Writing to it
+// neither blocks nor fails, so that it cannot disturb the response, and it
+// holds nothing but the bytes kept, dropped along with the response.
+type metaExtractor struct {
+	contentType string
+	encoding    string
+	buf         bytes.Buffer
+}
+
+// newMetaExtractor returns an extractor for a body with the given content
+// type header, which may carry the charset, and content encoding.
+func newMetaExtractor(contentType, encoding string) *metaExtractor {
+	return &metaExtractor{contentType: contentType, encoding: encoding}
+}
+
+func (m *metaExtractor) Write(p []byte) (int, error) {
+	if room := headScanLimit - m.buf.Len(); room > 0 {
+		m.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// finish extracts the metadata from what was written.
+func (m *metaExtractor) finish() pageMeta {
+	r, err := decodeReader(m.encoding, &m.buf)
+	if err != nil {
+		return pageMeta{}
+	}
+	if r, err = charset.NewReader(io.LimitReader(r, headScanLimit), m.contentType); err != nil {
+		return pageMeta{}
+	}
+	return extractMeta(r)
+}
+
+// decodeReader decompresses a body with the given content encoding.
+func decodeReader(encoding string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return flate.NewReader(r), nil
+	}
+	return r, nil
+}
+
+// extractMeta reads the head of an HTML document.
+func extractMeta(r io.Reader) (m pageMeta) {
+	z := html.NewTokenizer(r)
+	var description string
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return finishMeta(m, description)
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				return finishMeta(m, description)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				attrs[string(k)] = string(v)
+			}
+			switch string(name) {
+			case "html":
+				m.Language = attrs["lang"]
+			case "title":
+				if m.Title == "" && tt == html.StartTagToken {
+					m.Title = readText(z)
+				}
+			case "meta":
+				content := attrs["content"]
+				switch {
+				case attrs["property"] == "og:title":
+					m.OgTitle = content
+				case strings.EqualFold(attrs["name"], "description"):
+					m.Description = content
+				case attrs["property"] == "og:description":
+					description = content
+				case strings.EqualFold(attrs["http-equiv"], "content-language") && m.Language == "":
+					m.Language = content
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					if rel == "canonical" {
+						m.Canonical = attrs["href"]
+					}
+				}
+			case "body":
+				return finishMeta(m, description)
+			}
+		}
+	}
+}
+
+// readText reads the text up to the end of the current element.
+func readText(z *html.Tokenizer) string {
+	var b strings.Builder
+	for {
+		switch z.Next() {
+		case html.TextToken:
+			b.Write(z.Text())
+		default:
+			return strings.Join(strings.Fields(b.String()), " ")
+		}
+	}
+}
+
+func finishMeta(m pageMeta, description string) pageMeta {
+	if m.Title == "" {
+		m.Title = m.OgTitle
+	}
+	if m.Description == "" {
+		m.Description = description
+	}
+	m.Title = truncate(m.Title, 400)
+	m.OgTitle = truncate(m.OgTitle, 400)
+	m.Description = truncate(m.Description, 1000)
+	m.Canonical = truncate(m.Canonical, 1000)
+	m.Language = truncate(m.Language, 32)
+	return m
+}
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestExtractMeta(t *testing.T) {
+	page := `<!DOCTYPE html><html lang="en-US"><head>
+		<script>` + strings.Repeat("var x = '<title>not this</title>';", 1000) + `</script>
+		<title>
+			Tom &amp; Jerry &#8211; Cartoons
+		</title>
+		<meta property="og:title" content="Tom and Jerry">
+		<meta property="og:description" content="From og">
+		<meta name="Description" content="Classic cartoons">
+		<link rel="alternate canonical" href="https://example.com/tom">
+		</head><body><svg><title>icon</title></svg></body></html>`
+	m := extractMeta(strings.NewReader(page))
+	want := pageMeta{"Tom & Jerry – Cartoons", "Tom and Jerry", "Classic cartoons", "https://example.com/tom", "en-US"}
+	if m != want {
+		t.Errorf("Expected %+v, got %+v", want, m)
+	}
+
+	m = extractMeta(strings.NewReader(`<head><meta property="og:title" content="Only og"><meta property="og:description" content="From og"><body>`))
+	if m.Title != "Only og" || m.Description != "From og" {
+		t.Errorf("Expected og fallbacks, got %+v", m)
+	}
+}
+
+func TestMetaExtractorStreaming(t *testing.T) {
+	// é in ISO-8859-1, compressed, written in small chunks
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("<html><head><title>Caf\xe9</title></head><body>" + strings.Repeat("x", 100000) + "</body></html>"))
+	w.Close()
+
+	m := newMetaExtractor("text/html; charset=iso-8859-1", "gzip")
+	c := newCapture(io.NopCloser(&buf), 0, nil)
+	c.tee = m
+	p := make([]byte, 100)
+	for {
+		if _, err := c.Read(p); err != nil {
+			break
+		}
+	}
+	if got := m.finish(); got.Title != "Café" {
+		t.Errorf("Expected Café, got %+v", got)
+	}
+}
+
+func TestMetaExtractorBounded(t *testing.T) {
+	// nothing consumes the writes until the end, which neither block nor
+	// keep more than the limit
+	m := newMetaExtractor("text/html", "")
+	m.Write([]byte("<html><head><title>Clarity</title></head><body>"))
+	chunk := []byte(strings.Repeat("x", 64*1024))
+	for n := 0; n < 2*headScanLimit/len(chunk); n++ {
+		if k, err := m.Write(chunk); k != len(chunk) || err != nil {
+			t.Fatalf("Expected the write to succeed, got %d, %v", k, err)
+		}
+	}
+	if m.buf.Len() != headScanLimit {
+		t.Errorf("Expected %d bytes kept, got %d", headScanLimit, m.buf.Len())
+	}
+	if got := m.finish(); got.Title != "Clarity" {
+		t.Errorf("Expected Clarity, got %+v", got)
+	}
+}
@@ -0,0 +1,23 @@
+package logging
+
+import "shawnma.com/clarity/metrics"
+
+var (
+	requestsTotal = metrics.NewCounterVec("clarity_requests_total",
+		"Requests seen by the proxy by decision, class and client.", "decision", "class", "client")
+	upstreamLatency = metrics.NewHistogram("clarity_upstream_latency_seconds",
+		"Time from the start of the requests to the first byte of the upstream responses.", metrics.DefaultBuckets)
+	logQueueDepth = metrics.NewGaugeVec("clarity_log_queue_depth",
+		"Access log entries waiting to be written.", "provider")
+	logDropped = metrics.NewCounterVec("clarity_log_dropped_total",
+		"Access log entries dropped because the queue stayed full or was closed.", "provider")
+)
+
+// CountRequest accounts the request of the log entry in the metrics.
+func CountRequest(h *HttpLog) {
+	decision := h.Decision
+	if decision == "" {
+		decision = "allowed"
+	}
+	requestsTotal.Inc(decision, h.Class, h.ClientIP())
+}
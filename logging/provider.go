@@ -4,29 +4,52 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"slices"
+	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"shawnma.com/clarity/config"
 )
 
 type consoleLogger struct{}
 
 func (c *consoleLogger) Log(l *HttpLog) {
-	log.Printf("ACCESS: %s", l)
+	log.Info("access", "request", l.RequestId, "log", l)
 }
 
+func (c *consoleLogger) LogSearch(e *SearchEvent) {
+	log.Info("search", "event", e)
+}
+
+const (
+	// logQueueSize bounds the entries waiting for the DB
+	logQueueSize = 1024
+	// how long a request waits for room in the full queue, slowing the proxy
+	// down, before its entry is dropped
+	logQueueWait = time.Second
+	// how long the shutdown waits for the queued entries to be written
+	logFlushTimeout = 10 * time.Second
+)
+
 type MysqlLogger struct {
-	db *sql.DB
+	db    *sql.DB
+	queue *writeQueue
 }
 
 func newMysqlLogger(c *config.Config) (*MysqlLogger, error) {
 	if c.Logs.Config["url"] == "" {
 		return nil, errors.New("no URL provided for DB Logger")
 	}
-	log.Print("Creating DB logger")
-	db, err := sql.Open("mysql", c.Logs.Config["url"])
+	log.Info("creating DB logger")
+	dsn, err := mysql.ParseDSN(c.Logs.Config["url"])
+	if err != nil {
+		return nil, err
+	}
+	// LogTime is read back by the history queries
+	dsn.ParseTime = true
+	dsn.Loc = time.Local
+	db, err := sql.Open("mysql", dsn.FormatDSN())
 	if err != nil {
 		return nil, err
 	}
@@ -34,20 +57,290 @@ func newMysqlLogger(c *config.Config) (*MysqlLogger, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MysqlLogger{db}, nil
+	if err := checkSchema(db); err != nil {
+		return nil, err
+	}
+	return &MysqlLogger{db, newWriteQueue("db", logQueueSize, logQueueWait)}, nil
+}
+
+// schema lists the columns of the tables the logger writes and reads, which
+// the databases of earlier versions may miss.
+var schema = []struct {
+	table   string
+	columns []string
+}{
+	{"LOG", []string{"Id", "RemoteAddr", "ClientIP", "Method", "RequestContentType", "RequestLength", "RequestBody",
+		"ResponseCode", "ResponseContentType", "ResponseLength", "ResponseBody", "Title", "OgTitle",
+		"Description", "Canonical", "Language", "Class", "Policy", "Decision", "URL", "LogTime",
+		"RequestBytes", "ResponseBytes", "TtfbMs", "DurationMs", "UpstreamIP", "RequestId"}},
+	{"SEARCH", []string{"Id", "Client", "Engine", "Query", "URL", "LogTime"}},
+}
+
+// checkSchema fails when columns are missing, as every insert would fail
+// otherwise, telling which ones to add.
+func checkSchema(db *sql.DB) error {
+	var missing []string
+	for _, t := range schema {
+		rows, err := db.Query(`SELECT COLUMN_NAME FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`, t.table)
+		if err != nil {
+			return err
+		}
+		var have []string
+		for rows.Next() {
+			var c string
+			if err := rows.Scan(&c); err != nil {
+				rows.Close()
+				return err
+			}
+			have = append(have, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		missing = append(missing, missingColumns(t.table, t.columns, have)...)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the database misses the columns %s, see the upgrade statements in logging/db.sql",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingColumns returns the columns of the table not in have, as table.column.
+func missingColumns(table string, columns, have []string) []string {
+	var missing []string
+	for _, c := range columns {
+		if !slices.ContainsFunc(have, func(h string) bool { return strings.EqualFold(h, c) }) {
+			missing = append(missing, table+"."+c)
+		}
+	}
+	return missing
+}
+
+// Close writes the queued entries, giving up after logFlushTimeout, and
+// closes the DB. Entries logged afterwards are dropped.
+func (logger *MysqlLogger) Close() error {
+	logger.queue.close(logFlushTimeout)
+	return logger.db.Close()
 }
 
 func (logger *MysqlLogger) Log(l *HttpLog) {
-	stmt := `INSERT INTO LOG(RemoteAddr, Method,RequestContentType,RequestLength,RequestBody,
-		ResponseCode,ResponseContentType,ResponseLength,ResponseBody,Title,URL,LogTime)
-		 VALUES (?, ?, ?, ?,?,?,?,?,?,?,?,?)`
-	_, e := logger.db.Exec(stmt, l.RemoteAddr, l.Method,
+	logger.queue.add(func() { logger.insert(l) })
+}
+
+func (logger *MysqlLogger) insert(l *HttpLog) {
+	stmt := `INSERT INTO LOG(RemoteAddr, ClientIP, Method,RequestContentType,RequestLength,RequestBody,
+		ResponseCode,ResponseContentType,ResponseLength,ResponseBody,Title,OgTitle,Description,Canonical,Language,Class,Policy,Decision,URL,LogTime,
+		RequestBytes,ResponseBytes,TtfbMs,DurationMs,UpstreamIP,RequestId)
+		 VALUES (?, ?, ?, ?, ?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+	_, e := logger.db.Exec(stmt, l.RemoteAddr, l.ClientIP(), l.Method,
 		l.RequestContentType, l.RequestLength, l.RequestBody,
 		l.ResponseCode, l.ResponseContentType, l.ResponseLength, l.ResponseBody, l.Title,
-		l.Url, time.Now())
+		l.OgTitle, l.Description, l.Canonical, l.Language, l.Class, l.Policy, l.Decision, l.Url, l.Time,
+		l.RequestBytes, l.ResponseBytes, l.TTFB.Milliseconds(), l.Duration.Milliseconds(), l.UpstreamIP, l.RequestId)
 	if e != nil {
-		log.Printf("Unable to log to DB: %s, DATA: %s", e, l)
+		log.Error("unable to log to DB", "request", l.RequestId, "err", e, "data", l)
+	}
+}
+
+func (logger *MysqlLogger) LogSearch(e *SearchEvent) {
+	logger.queue.add(func() { logger.insertSearch(e) })
+}
+
+func (logger *MysqlLogger) insertSearch(e *SearchEvent) {
+	stmt := `INSERT INTO SEARCH(Client, Engine, Query, URL, LogTime) VALUES (?, ?, ?, ?, ?)`
+	if _, err := logger.db.Exec(stmt, e.Client, e.Engine, e.Query, e.Url, e.Time); err != nil {
+		log.Error("unable to log search to DB", "err", err, "data", e)
+	}
+}
+
+const historyColumns = `Id, RemoteAddr, Method, RequestContentType, RequestLength,
+	ResponseCode, ResponseContentType, ResponseLength, Title, OgTitle, Description, Canonical, Language, Class, Policy, Decision, URL, LogTime,
+	RequestBytes, ResponseBytes, TtfbMs, DurationMs, UpstreamIP, RequestId`
+
+func (logger *MysqlLogger) Query(q *HistoryQuery) (*HistoryPage, error) {
+	where, args := historyWhere(q)
+	page := &HistoryPage{Size: q.Size}
+	// the following pages don't scan the matching rows again
+	if q.Before == nil {
+		if err := logger.db.QueryRow("SELECT COUNT(*) FROM LOG"+where, args...).Scan(&page.Total); err != nil {
+			return nil, err
+		}
 	}
+	where, args = before(where, args, q.Before)
+	rows, err := logger.db.Query("SELECT "+historyColumns+" FROM LOG"+where+" ORDER BY LogTime DESC, Id DESC LIMIT ?",
+		append(args, q.Size)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l HttpLog
+		var title, ogTitle, description, canonical, language, class, policy, decision, upstream, requestId sql.NullString
+		var requestBytes, responseBytes, ttfb, duration sql.NullInt64
+		err := rows.Scan(&l.Id, &l.RemoteAddr, &l.Method, &l.RequestContentType, &l.RequestLength,
+			&l.ResponseCode, &l.ResponseContentType, &l.ResponseLength, &title, &ogTitle, &description,
+			&canonical, &language, &class, &policy, &decision, &l.Url, &l.Time,
+			&requestBytes, &responseBytes, &ttfb, &duration, &upstream, &requestId)
+		if err != nil {
+			return nil, err
+		}
+		l.RequestBytes, l.ResponseBytes, l.UpstreamIP = requestBytes.Int64, responseBytes.Int64, upstream.String
+		l.TTFB = time.Duration(ttfb.Int64) * time.Millisecond
+		l.Duration = time.Duration(duration.Int64) * time.Millisecond
+		l.Title, l.OgTitle, l.Description, l.Canonical, l.Language = title.String, ogTitle.String,
+			description.String, canonical.String, language.String
+		l.Class, l.Policy, l.Decision, l.RequestId = class.String, policy.String, decision.String, requestId.String
+		page.Items = append(page.Items, &l)
+	}
+	if len(page.Items) == q.Size {
+		last := page.Items[len(page.Items)-1]
+		page.Next = &Cursor{last.Time, last.Id}
+	}
+	return page, rows.Err()
+}
+
+func (logger *MysqlLogger) Searches(q *HistoryQuery) (*SearchPage, error) {
+	where, args := searchWhere(q)
+	page := &SearchPage{Size: q.Size}
+	// the following pages don't scan the matching rows again
+	if q.Before == nil {
+		if err := logger.db.QueryRow("SELECT COUNT(*) FROM SEARCH"+where, args...).Scan(&page.Total); err != nil {
+			return nil, err
+		}
+	}
+	where, args = before(where, args, q.Before)
+	rows, err := logger.db.Query("SELECT Id, Client, Engine, Query, URL, LogTime FROM SEARCH"+where+
+		" ORDER BY LogTime DESC, Id DESC LIMIT ?", append(args, q.Size)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e SearchEvent
+		if err := rows.Scan(&e.Id, &e.Client, &e.Engine, &e.Query, &e.Url, &e.Time); err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, &e)
+	}
+	if len(page.Items) == q.Size {
+		last := page.Items[len(page.Items)-1]
+		page.Next = &Cursor{last.Time, last.Id}
+	}
+	return page, rows.Err()
+}
+
+func (logger *MysqlLogger) Clients() ([]string, error) {
+	// served by the index on ClientIP
+	rows, err := logger.db.Query("SELECT DISTINCT ClientIP FROM LOG WHERE ClientIP IS NOT NULL ORDER BY ClientIP")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clients []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// historyWhere builds the WHERE clause and its arguments for a history query.
+func historyWhere(q *HistoryQuery) (string, []any) {
+	var cond []string
+	var args []any
+	if q.Client != "" {
+		cond = append(cond, "ClientIP = ?")
+		args = append(args, q.Client)
+	}
+	if q.Host != "" {
+		// the host is either the whole host name or a domain suffix of it, followed by a port,
+		// a path or nothing.
+		h := escapeLike(q.Host)
+		var hc []string
+		for _, prefix := range []string{"%//", "%."} {
+			for _, suffix := range []string{"", ":%", "/%"} {
+				hc = append(hc, "URL LIKE ?")
+				args = append(args, prefix+h+suffix)
+			}
+		}
+		cond = append(cond, "("+strings.Join(hc, " OR ")+")")
+	}
+	if !q.From.IsZero() {
+		cond = append(cond, "LogTime >= ?")
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		cond = append(cond, "LogTime < ?")
+		args = append(args, q.To)
+	}
+	if q.Class != "" {
+		cond = append(cond, "Class = ?")
+		args = append(args, q.Class)
+	}
+	if q.Text != "" {
+		t := "%" + escapeLike(q.Text) + "%"
+		cond = append(cond, "(Title LIKE ? OR URL LIKE ?)")
+		args = append(args, t, t)
+	}
+	if len(cond) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(cond, " AND "), args
+}
+
+// searchWhere builds the WHERE clause of a search query, the text is searched
+// in the queries.
+func searchWhere(q *HistoryQuery) (string, []any) {
+	var cond []string
+	var args []any
+	if q.Client != "" {
+		cond = append(cond, "Client = ?")
+		args = append(args, q.Client)
+	}
+	if !q.From.IsZero() {
+		cond = append(cond, "LogTime >= ?")
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		cond = append(cond, "LogTime < ?")
+		args = append(args, q.To)
+	}
+	if q.Text != "" {
+		cond = append(cond, "Query LIKE ?")
+		args = append(args, "%"+escapeLike(q.Text)+"%")
+	}
+	if len(cond) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(cond, " AND "), args
+}
+
+// before adds the condition of the rows older than the cursor, if any, to
+// the WHERE clause, which the index on LogTime serves without skipping the
+// rows of the previous pages.
+func before(where string, args []any, c *Cursor) (string, []any) {
+	if c == nil {
+		return where, args
+	}
+	cond := "(LogTime < ? OR (LogTime = ? AND Id < ?))"
+	if where == "" {
+		where = " WHERE " + cond
+	} else {
+		where += " AND " + cond
+	}
+	return where, append(args, c.Time, c.Time, c.Id)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
 }
 
 func NewAccessLogger(c *config.Config) (AccessLogger, error) {
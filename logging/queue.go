@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// writeQueue runs the writes of a provider on its own goroutine, so the
+// proxy doesn't wait on them unless they fall behind.
+type writeQueue struct {
+	// label of the provider in the metrics
+	provider string
+	writes   chan func()
+	// how long an entry waits for room in a full queue before being dropped
+	wait time.Duration
+	// guards closing writes against the entries being added
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newWriteQueue(provider string, size int, wait time.Duration) *writeQueue {
+	q := &writeQueue{provider: provider, writes: make(chan func(), size), wait: wait, done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+func (q *writeQueue) run() {
+	defer close(q.done)
+	for write := range q.writes {
+		logQueueDepth.Dec(q.provider)
+		write()
+	}
+}
+
+// add queues the write, waiting for room when the queue is full, and drops it
+// when there is none in time or the queue is closed.
+func (q *writeQueue) add(write func()) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		logDropped.Inc(q.provider)
+		return
+	}
+	logQueueDepth.Inc(q.provider)
+	select {
+	case q.writes <- write:
+		return
+	default:
+	}
+	t := time.NewTimer(q.wait)
+	defer t.Stop()
+	select {
+	case q.writes <- write:
+	case <-t.C:
+		logQueueDepth.Dec(q.provider)
+		logDropped.Inc(q.provider)
+		log.Warn("access log queue full, dropping an entry", "provider", q.provider)
+	}
+}
+
+// close stops taking entries and waits for the queued ones to be written, up
+// to timeout. It tells whether they all were.
+func (q *writeQueue) close(timeout time.Duration) bool {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.writes)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+		return true
+	case <-time.After(timeout):
+		log.Warn("gave up writing the queued access logs", "provider", q.provider, "left", len(q.writes))
+		return false
+	}
+}
@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteQueueWaitsForRoom(t *testing.T) {
+	q := newWriteQueue("test", 1, time.Second)
+	var written atomic.Int32
+	release := make(chan struct{})
+	// the first write holds the goroutine, the second fills the queue
+	q.add(func() { <-release; written.Add(1) })
+	q.add(func() { written.Add(1) })
+	added := make(chan struct{})
+	go func() {
+		q.add(func() { written.Add(1) })
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("Expected the write to wait for room in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-added
+	if !q.close(time.Second) {
+		t.Fatal("Expected the queue to be flushed")
+	}
+	if n := written.Load(); n != 3 {
+		t.Errorf("Expected 3 writes, got %d", n)
+	}
+	// dropped once closed
+	q.add(func() { written.Add(1) })
+	if n := written.Load(); n != 3 {
+		t.Errorf("Expected no write after closing, got %d", n)
+	}
+}
+
+func TestWriteQueueDropsWhenFull(t *testing.T) {
+	q := newWriteQueue("test", 1, 10*time.Millisecond)
+	release := make(chan struct{})
+	var written atomic.Int32
+	for n := 0; n < 3; n++ {
+		q.add(func() { <-release; written.Add(1) })
+	}
+	close(release)
+	q.close(time.Second)
+	if n := written.Load(); n != 2 {
+		t.Errorf("Expected the third write dropped, got %d writes", n)
+	}
+}
@@ -0,0 +1,283 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"shawnma.com/clarity/config"
+)
+
+const redacted = "[REDACTED]"
+
+// Form fields, JSON keys and query params containing any of these are
+// redacted, along with the configured ones. Authorization and cookie values
+// sometimes travel in bodies and query strings as well.
+var defaultRedactFields = []string{"password", "passwd", "token", "secret", "apikey", "api_key",
+	"authorization", "cookie", "session", "credential", "ssn"}
+
+// Card numbers have 13 to 19 digits, optionally grouped with spaces or dashes.
+// The runs matching are checked further by cardNumber.
+var cardExp = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+// redactor strips sensitive data from what is logged.
+type redactor struct {
+	fields []string
+	cards  bool
+}
+
+func newRedactor(c config.RedactConfig) *redactor {
+	r := &redactor{fields: slices.Clone(defaultRedactFields), cards: !c.KeepCardNumbers}
+	for _, f := range c.Fields {
+		r.fields = append(r.fields, strings.ToLower(f))
+	}
+	return r
+}
+
+func (r *redactor) sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, f := range r.fields {
+		if strings.Contains(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// url returns the URL with sensitive query params redacted.
+func (r *redactor) url(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = r.form(u.RawQuery)
+	return c.String()
+}
+
+// body redacts a request body of the given content type.
+func (r *redactor) body(ct, body string) string {
+	if body == "" {
+		return body
+	}
+	switch {
+	case ct == "application/x-www-form-urlencoded":
+		return r.form(body)
+	case strings.HasSuffix(ct, "json"):
+		var v any
+		if err := json.Unmarshal([]byte(body), &v); err == nil {
+			if b, err := json.Marshal(r.json(v)); err == nil {
+				return string(b)
+			}
+		}
+		// the capture stops at its limit
+		if b, ok := r.partialJSON(body); ok {
+			return b
+		}
+	}
+	return r.text(body)
+}
+
+// partialJSON redacts a JSON document cut short, token by token up to where
+// it stops, dropping the token cut in the middle.
+func (r *redactor) partialJSON(body string) (string, bool) {
+	d := json.NewDecoder(strings.NewReader(body))
+	d.UseNumber()
+	var b strings.Builder
+	// the open objects and arrays, with the count of keys and values in them
+	type container struct {
+		object bool
+		n      int
+	}
+	var stack []container
+	// depth of the redacted value being skipped
+	skip := 0
+	redactNext := false
+	tokens := 0
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		tokens++
+		delim, isDelim := t.(json.Delim)
+		open := isDelim && (delim == '{' || delim == '[')
+		if skip > 0 {
+			if open {
+				skip++
+			} else if isDelim {
+				skip--
+			}
+			continue
+		}
+		if redactNext {
+			// its key was written along with the redacted value
+			redactNext = false
+			if open {
+				skip = 1
+			}
+			continue
+		}
+		if isDelim && !open {
+			stack = stack[:len(stack)-1]
+			b.WriteRune(rune(delim))
+			continue
+		}
+		key := false
+		if n := len(stack); n > 0 {
+			c := &stack[n-1]
+			key = c.object && c.n%2 == 0
+			if c.object && !key {
+				b.WriteByte(':')
+			} else if c.n > 0 {
+				b.WriteByte(',')
+			}
+			c.n++
+		}
+		switch v := t.(type) {
+		case json.Delim:
+			b.WriteRune(rune(v))
+			stack = append(stack, container{object: v == '{'})
+		case string:
+			if key {
+				writeJSONString(&b, v)
+				if r.sensitive(v) {
+					b.WriteString(":")
+					writeJSONString(&b, redacted)
+					stack[len(stack)-1].n++
+					redactNext = true
+				}
+			} else {
+				writeJSONString(&b, r.text(v))
+			}
+		case json.Number:
+			b.WriteString(r.text(v.String()))
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		case nil:
+			b.WriteString("null")
+		}
+	}
+	return b.String(), tokens > 0
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	q, _ := json.Marshal(s)
+	b.Write(q)
+}
+
+// form redacts an url encoded form or query string, keeping the order of the
+// fields.
+func (r *redactor) form(q string) string {
+	pairs := strings.Split(q, "&")
+	for i, p := range pairs {
+		k, v, found := strings.Cut(p, "=")
+		if !found {
+			continue
+		}
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		if r.sensitive(name) {
+			pairs[i] = k + "=" + url.QueryEscape(redacted)
+		} else if value, err := url.QueryUnescape(v); err == nil && r.cards {
+			if rv := r.text(value); rv != value {
+				pairs[i] = k + "=" + url.QueryEscape(rv)
+			}
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (r *redactor) json(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, e := range t {
+			if r.sensitive(k) {
+				t[k] = redacted
+			} else {
+				t[k] = r.json(e)
+			}
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = r.json(e)
+		}
+	case string:
+		return r.text(t)
+	}
+	return v
+}
+
+// text redacts what looks like card numbers.
+func (r *redactor) text(s string) string {
+	if !r.cards {
+		return s
+	}
+	return cardExp.ReplaceAllStringFunc(s, func(m string) string {
+		if cardNumber(m) {
+			return redacted
+		}
+		return m
+	})
+}
+
+// cardNumber tells if the digits in s look like a card number: starting with
+// the prefix of a major network, with a length it issues, and passing the Luhn
+// checksum. Other long numbers, such as timestamps and ids, are kept.
+func cardNumber(s string) bool {
+	d := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, s)
+	n := len(d)
+	if n < 13 {
+		return false
+	}
+	prefix := func(digits int) int {
+		p, _ := strconv.Atoi(d[:digits])
+		return p
+	}
+	var ok bool
+	switch p2, p4 := prefix(2), prefix(4); {
+	case d[0] == '4': // Visa
+		ok = n == 13 || n == 16 || n == 19
+	case p2 == 34 || p2 == 37: // American Express
+		ok = n == 15
+	case p2 >= 51 && p2 <= 55, p4 >= 2221 && p4 <= 2720: // Mastercard
+		ok = n == 16
+	case p2 == 36 || p2 == 38 || (prefix(3) >= 300 && prefix(3) <= 305): // Diners Club
+		ok = n >= 14 && n <= 16
+	case p4 >= 3528 && p4 <= 3589: // JCB
+		ok = n >= 16 && n <= 19
+	case d[0] == '6': // Discover, UnionPay, Maestro
+		ok = n >= 16 && n <= 19
+	}
+	return ok && luhn(d)
+}
+
+// luhn tells if the digits in s pass the Luhn checksum.
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"shawnma.com/clarity/config"
+)
+
+func TestRedact(t *testing.T) {
+	r := newRedactor(config.RedactConfig{})
+	tests := []struct {
+		name string
+		ct   string
+		body string
+		want string
+	}{
+		{"form", "application/x-www-form-urlencoded", "user=emma&Password=hunter2&remember=1",
+			"user=emma&Password=%5BREDACTED%5D&remember=1"},
+		{"json", "application/json", `{"user":"emma","auth":{"access_token":"abc"},"cards":["4111 1111 1111 1111"]}`,
+			`{"auth":{"access_token":"[REDACTED]"},"cards":["[REDACTED]"],"user":"emma"}`},
+		{"text card", "text/plain", "card 4111-1111-1111-1111 order 1234567890123", "card [REDACTED] order 1234567890123"},
+		{"truncated json", "application/json", `{"password": 4111111111111111`, `{"password":"[REDACTED]"`},
+		{"truncated json value", "application/json", `{"user":"emma","auth":{"token":"abc","scope":"all"},"session_id":"12`,
+			`{"user":"emma","auth":{"token":"[REDACTED]","scope":"all"},"session_id":"[REDACTED]"`},
+		{"truncated json object", "application/json", `[{"credential":{"user":"emma","key":"x"}},{"card":"4111111111111111"},{"no`,
+			`[{"credential":"[REDACTED]"},{"card":"[REDACTED]"},{`},
+		{"not json", "application/json", `<html>4111111111111111`, `<html>[REDACTED]`},
+	}
+	for _, tc := range tests {
+		if got := r.body(tc.ct, tc.body); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+
+	u, _ := url.Parse("https://example.com/login?next=/home&session_id=42&cc=4111111111111111")
+	if got := r.url(u); got != "https://example.com/login?next=/home&session_id=%5BREDACTED%5D&cc=%5BREDACTED%5D" {
+		t.Errorf("Wrong redacted url: %s", got)
+	}
+
+	// the configured fields extend the defaults
+	keep := newRedactor(config.RedactConfig{Fields: []string{"pin"}, KeepCardNumbers: true})
+	if got := keep.body("application/x-www-form-urlencoded", "PIN=1234&password=x&cc=4111111111111111"); got != "PIN=%5BREDACTED%5D&password=%5BREDACTED%5D&cc=4111111111111111" {
+		t.Errorf("Wrong configured redaction: %s", got)
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	if !luhn("4111 1111 1111 1111") || !luhn("79927398713") || luhn("4111 1111 1111 1112") {
+		t.Errorf("Wrong luhn check")
+	}
+}
+
+func TestCardNumber(t *testing.T) {
+	tests := []struct {
+		s    string
+		card bool
+	}{
+		{"4111 1111 1111 1111", true},
+		{"5555-5555-5555-4444", true},
+		{"2223003122003222", true},
+		{"378282246310005", true},
+		{"6011111111111117", true},
+		{"3530111333300000", true},
+		{"30569309025904", true},
+		// passing the Luhn check, but no card
+		{"1000000000009", false},
+		{"9999999999999995", false},
+		// a Visa prefix with the length of none
+		{"411111111111110", false},
+		{"4111 1111 1111 1112", false},
+	}
+	for _, tc := range tests {
+		if got := cardNumber(tc.s); got != tc.card {
+			t.Errorf("%s: expected %v, got %v", tc.s, tc.card, got)
+		}
+	}
+}
+
+type memLogger struct {
+	logs []*HttpLog
+}
+
+func (l *memLogger) Log(h *HttpLog)           { l.logs = append(l.logs, h) }
+func (l *memLogger) LogSearch(e *SearchEvent) {}
+
+func TestLogRedactsTruncatedBodies(t *testing.T) {
+	m := &memLogger{}
+	l := NewLogger(&config.Config{Logs: config.LogsConfig{Body: config.BodyConfig{MaxRequest: 48, MaxResponse: 48}}}, m)
+	// sensitive fields first, cut short past the limits
+	long := strings.Repeat("x", 100)
+	req, _ := http.NewRequest("POST", "https://example.com/login",
+		strings.NewReader(`{"password":"hunter2","user":"emma","notes":"`+long+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+	if err := l.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(req.Body)
+	res := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"access_token":"abc","data":"` + long + `"}`)),
+		Request:    req,
+	}
+	if err := l.ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if len(m.logs) != 1 {
+		t.Fatalf("Expected one log, got %d", len(m.logs))
+	}
+	h := m.logs[0]
+	if strings.Contains(h.RequestBody, "hunter2") || !strings.HasPrefix(h.RequestBody, `{"password":"[REDACTED]","user":"emma"`) {
+		t.Errorf("Expected the request password redacted, got %s", h.RequestBody)
+	}
+	if strings.Contains(h.ResponseBody, "abc") || !strings.HasPrefix(h.ResponseBody, `{"access_token":"[REDACTED]"`) {
+		t.Errorf("Expected the response token redacted, got %s", h.ResponseBody)
+	}
+	if len(h.RequestBody) > 48 || len(h.ResponseBody) > 48 {
+		t.Errorf("Expected the bodies cut to size, got %d and %d", len(h.RequestBody), len(h.ResponseBody))
+	}
+}
@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/util"
+)
+
+// Repeating the same search within this window, e.g. paging through the
+// results, is recorded once.
+const searchDedupWindow = time.Minute
+
+// SearchEvent is a search query made by a client on a search engine.
+type SearchEvent struct {
+	Id     int64
+	Engine string
+	Query  string
+	Client string
+	Time   time.Time
+	Url    string
+}
+
+func (e *SearchEvent) String() string {
+	return fmt.Sprintf("[%s | %s] %q %s", e.Client, e.Engine, e.Query, e.Url)
+}
+
+type searchRule struct {
+	engine string
+	// query string or form field holding the query
+	param string
+	// dot separated path of the query in a JSON body
+	json []string
+}
+
+// searchExtractor recognizes search requests using the configured rules.
+type searchExtractor struct {
+	rules util.UrlMatch[*searchRule]
+
+	mu sync.Mutex
+	// last event per client and engine, for deduplication
+	last map[string]*SearchEvent
+}
+
+func newSearchExtractor(engines []config.SearchEngine) (*searchExtractor, error) {
+	s := &searchExtractor{last: map[string]*SearchEvent{}}
+	for _, e := range engines {
+		if e.Engine == "" || e.Match == "" || (e.Param == "" && e.Json == "") {
+			return nil, fmt.Errorf("search engine needs engine, match and either param or json: %+v", e)
+		}
+		r := &searchRule{engine: e.Engine, param: e.Param}
+		if e.Json != "" {
+			r.json = strings.Split(e.Json, ".")
+		}
+		s.rules.Add(e.Match, r)
+	}
+	return s, nil
+}
+
+// matches tells if the request is sent to a search engine.
+func (s *searchExtractor) matches(req *http.Request) bool {
+	return s.rules.Match(req.URL.Hostname(), req.URL.Path) != nil
+}
+
+// extract returns the search made by the request, or nil if it is not a search
+// or repeats the previous one. The body is only looked at for form and JSON
+// content types.
+func (s *searchExtractor) extract(req *http.Request, ct, body string) *SearchEvent {
+	r := s.rules.Match(req.URL.Hostname(), req.URL.Path)
+	if r == nil {
+		return nil
+	}
+	var q string
+	if r.param != "" {
+		q = req.URL.Query().Get(r.param)
+		if q == "" && ct == "application/x-www-form-urlencoded" {
+			if form, err := url.ParseQuery(body); err == nil {
+				q = form.Get(r.param)
+			}
+		}
+	}
+	if q == "" && r.json != nil && strings.HasSuffix(ct, "json") {
+		q = jsonString(body, r.json)
+	}
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return nil
+	}
+	client := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(client); err == nil {
+		client = h
+	}
+	e := &SearchEvent{Engine: r.engine, Query: q, Client: client, Time: time.Now(), Url: req.URL.String()}
+	if len(e.Url) > 1000 {
+		e.Url = e.Url[:1000]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := client + " " + r.engine
+	if last := s.last[key]; last != nil && last.Query == q && e.Time.Sub(last.Time) < searchDedupWindow {
+		return nil
+	}
+	s.last[key] = e
+	return e
+}
+
+// jsonString returns the string at the given path of a JSON document.
+func jsonString(body string, path []string) string {
+	var v any
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return ""
+	}
+	for _, p := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = m[p]
+	}
+	s, _ := v.(string)
+	return s
+}
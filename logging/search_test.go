@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shawnma.com/clarity/config"
+)
+
+func TestSearchExtract(t *testing.T) {
+	s, err := newSearchExtractor([]config.SearchEngine{
+		{Engine: "google", Match: "google.com/search", Param: "q"},
+		{Engine: "duckduckgo", Match: "duckduckgo.com", Param: "q"},
+		{Engine: "youtube", Match: "youtube.com/results", Param: "search_query"},
+		{Engine: "youtube", Match: "youtube.com/youtubei/v1/search", Json: "query"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		ct     string
+		body   string
+		engine string
+		query  string
+	}{
+		{"query string", "GET", "https://www.google.com/search?q=math+games", "", "", "google", "math games"},
+		{"repeated", "GET", "https://www.google.com/search?q=math+games&start=10", "", "", "", ""},
+		{"not a search", "GET", "https://www.google.com/maps?q=home", "", "", "", ""},
+		{"form", "POST", "https://html.duckduckgo.com/html/", "application/x-www-form-urlencoded", "q=lego&b=", "duckduckgo", "lego"},
+		{"youtube", "GET", "https://www.youtube.com/results?search_query=minecraft", "", "", "youtube", "minecraft"},
+		{"json", "POST", "https://www.youtube.com/youtubei/v1/search", "application/json", `{"context":{},"query":"cats"}`, "youtube", "cats"},
+		{"empty", "GET", "https://www.google.com/search?q=+", "", "", "", ""},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		e := s.extract(req, tc.ct, tc.body)
+		if tc.engine == "" {
+			if e != nil {
+				t.Errorf("%s: expected no search, got %s", tc.name, e)
+			}
+			continue
+		}
+		if e == nil || e.Engine != tc.engine || e.Query != tc.query || e.Client != "192.0.2.1" {
+			t.Errorf("%s: expected %s %q, got %v", tc.name, tc.engine, tc.query, e)
+		}
+	}
+}
+
+func TestSearchEngineConfig(t *testing.T) {
+	if _, err := newSearchExtractor([]config.SearchEngine{{Engine: "bing", Match: "bing.com/search"}}); err == nil {
+		t.Errorf("Expected error for a rule without param or json")
+	}
+}
@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/google/martian/v3"
+)
+
+// tracingRoundTripper records the upstream address and the time to first byte
+// of the requests it sends into their log entries.
+type tracingRoundTripper struct {
+	rt http.RoundTripper
+}
+
+// NewRoundTripper wraps the round tripper of the proxy so that the upstream
+// side of requests gets logged.
+func NewRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &tracingRoundTripper{rt}
+}
+
+func (t *tracingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := FromContext(martian.NewContext(req))
+	if h == nil {
+		return t.rt.RoundTrip(req)
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				h.UpstreamIP = addr.IP.String()
+			} else if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				h.UpstreamIP = host
+			}
+		},
+		GotFirstResponseByte: func() {
+			h.TTFB = time.Since(h.Time)
+			upstreamLatency.Observe(h.TTFB.Seconds())
+		},
+	}
+	return t.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+)
+
+func TestRoundTripperTrace(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+	h := &HttpLog{Time: time.Now()}
+	ctx.Set("log", h)
+
+	res, err := NewRoundTripper(http.DefaultTransport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if h.UpstreamIP != "127.0.0.1" || h.TTFB < 10*time.Millisecond {
+		t.Errorf("Expected upstream 127.0.0.1 after 10ms, got %s after %s", h.UpstreamIP, h.TTFB)
+	}
+}
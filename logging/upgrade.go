@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// upgraded is the body of a response switching protocols, e.g. to a
+// WebSocket: the connection to the server, written to as well. The session is
+// logged once it's closed, with its duration and the bytes sent each way.
+type upgraded struct {
+	io.ReadWriteCloser
+	read, written atomic.Int64
+	once          sync.Once
+	done          func(read, written int64)
+}
+
+func newUpgraded(rwc io.ReadWriteCloser, done func(read, written int64)) *upgraded {
+	return &upgraded{ReadWriteCloser: rwc, done: done}
+}
+
+func (u *upgraded) Read(b []byte) (int, error) {
+	n, err := u.ReadWriteCloser.Read(b)
+	u.read.Add(int64(n))
+	return n, err
+}
+
+func (u *upgraded) Write(b []byte) (int, error) {
+	n, err := u.ReadWriteCloser.Write(b)
+	u.written.Add(int64(n))
+	return n, err
+}
+
+func (u *upgraded) Close() error {
+	err := u.ReadWriteCloser.Close()
+	u.once.Do(func() { u.done(u.read.Load(), u.written.Load()) })
+	return err
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -23,28 +26,65 @@ import (
 	"github.com/google/martian/v3/martianhttp"
 	"github.com/google/martian/v3/mitm"
 	"github.com/google/martian/v3/servemux"
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/ca"
 	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/dns"
 	"shawnma.com/clarity/filter"
+	"shawnma.com/clarity/intercept"
 	"shawnma.com/clarity/logging"
+	"shawnma.com/clarity/metrics"
+	"shawnma.com/clarity/pac"
+	"shawnma.com/clarity/report"
+	"shawnma.com/clarity/socks"
+	"shawnma.com/clarity/transparent"
+	"shawnma.com/clarity/upstream"
 )
 
 var (
 	addr          = flag.String("addr", ":8080", "host:port of the proxy")
 	apiAddr       = flag.String("api-addr", ":8181", "host:port of the configuration API")
 	tlsAddr       = flag.String("tls-addr", ":4443", "host:port of the transparent proxy over TLS")
+	httpAddr      = flag.String("http-addr", "", "host:port of the transparent proxy for plain HTTP, e.g. :8081, empty to disable")
+	http2         = flag.Bool("http2", true, "use HTTP/2 with the clients and servers supporting it")
+	socksAddr     = flag.String("socks-addr", "", "host:port of the SOCKS5 proxy, e.g. :1080, empty to disable")
+	dnsAddr       = flag.String("dns-addr", "", "host:port of the filtering DNS server over UDP and TCP, empty to disable")
 	apiHost       = flag.String("api", "clarity.proxy", "hostname for the API")
-	cert          = flag.String("cert", "", "filepath to the CA certificate used to sign MITM certificates")
+	cert          = flag.String("cert", "", "filepath to the CA certificate used to sign MITM certificates, instead of the one in -data")
 	key           = flag.String("key", "", "filepath to the private key of the CA used to sign MITM certificates")
+	dataDir       = flag.String("data", "data", "directory of the persistent state, such as the CA")
 	organization  = flag.String("organization", "Clarity Proxy", "organization name for MITM certificates")
 	validity      = flag.Duration("validity", time.Hour, "window of time that MITM certificates are valid")
+	certCacheSize = flag.Int("cert-cache-size", 1000, "number of MITM certificates kept in memory and in -data")
 	allowCORS     = flag.Bool("cors", false, "allow CORS requests to configure the proxy")
-	skipTLSVerify = flag.Bool("skip-tls-verify", false, "skip TLS server verification; insecure")
-	level         = flag.Int("v", 0, "log level")
+	skipTLSVerify = flag.Bool("skip-tls-verify", false, "skip TLS server verification of all the hosts, see upstream.insecure for some; insecure")
+	logFormat     = flag.String("log-format", "text", "format of the logs, text or json")
+	logLevel      = flag.String("log-level", "info", "log levels, e.g. info,filter=debug,mitm=warn for the subsystems filter, logging, mitm and api")
+	verbosity     = flag.Int("v", 0, "deprecated, use -log-level: 1 for error, 2 for info, 3 for debug")
 )
 
+var mitmLog = applog.For("mitm")
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			reportCommand(os.Args[2:])
+			return
+		case "ca":
+			caCommand(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
-	mlog.SetLevel(*level)
+	levels, deprecated := logLevels()
+	if err := applog.Setup(os.Stderr, *logFormat, levels); err != nil {
+		applog.Fatal(slog.Default(), "invalid log flags", "err", err)
+	}
+	if deprecated {
+		slog.Warn("-v is deprecated, use -log-level", "log-level", levels)
+	}
+	mlog.SetLogger(applog.NewMartianLogger(mitmLog))
 	config := config.NewConfig()
 
 	p := martian.NewProxy()
@@ -52,23 +92,58 @@ func main() {
 
 	l, err := net.Listen("tcp", *addr)
 	if err != nil {
-		log.Fatal(err)
+		applog.Fatal(slog.Default(), "unable to listen", "addr", *addr, "err", err)
 	}
 
 	lAPI, err := net.Listen("tcp", *apiAddr)
 	if err != nil {
-		log.Fatal(err)
+		applog.Fatal(slog.Default(), "unable to listen", "addr", *apiAddr, "err", err)
 	}
-	log.Printf("martian: starting proxy on %s and api on %s", l.Addr().String(), lAPI.Addr().String())
+	slog.Info("starting proxy", "addr", l.Addr().String(), "api", lAPI.Addr().String())
 
 	mux := http.NewServeMux()
-	startMitm(p, mux)
+	up, err := upstream.New(config.Upstream)
+	if err != nil {
+		applog.Fatal(slog.Default(), "invalid upstream config", "err", err)
+	}
+	interceptor := startMitm(p, mux, l.Addr(), up)
+
+	accessLogger, err := logging.NewAccessLogger(config)
+	if err != nil {
+		applog.Fatal(slog.Default(), "unable to create access logger", "err", err)
+	}
+	if q, ok := accessLogger.(logging.Querier); ok {
+		history := logging.NewHistoryHandler(q)
+		configure("/config/history", history, mux)
+		configure("/config/history/searches", history, mux)
+		configure("/config/history/clients", history, mux)
+		configure("/config/report", report.NewHandler(q, config.SessionGap), mux)
+	}
 
-	stack := newStack(config)
-	filter := filter.NewFilter(config)
+	// original destinations of the connections redirected to the transparent
+	// listeners
+	dsts := transparent.NewDestinations()
+	stack := newStack(config, accessLogger, dsts, interceptor)
+	// after the logger, which logs the CONNECT requests
+	stack.AddResponseModifier(interceptor)
+	learned, err := filter.NewLearnedSkip(config.Pinning, filepath.Join(*dataDir, "learned-skip.json"))
+	if err != nil {
+		applog.Fatal(slog.Default(), "unable to load the learned skip list", "err", err)
+	}
+	filter := filter.NewFilter(config, accessLogger)
+	filter.SetLearnedSkip(learned)
+	interceptor.SetHandshakeCallback(learned.HandshakeDone)
+	interceptor.SetAccessLogger(logging.NewClassFilter(config, accessLogger))
 	stack.AddRequestModifier(filter)
+	// after the logger, which logs the WebSockets it relays
+	stack.AddResponseModifier(filter)
 	configure("/config/", filter.HttpHandler(), mux)
 
+	// auto-configuration of the devices, at the path WPAD looks for too
+	ph := pac.NewHandler(config.SkipProxy, l.Addr().(*net.TCPAddr).Port)
+	configure("/proxy.pac", ph, mux)
+	configure("/wpad.dat", ph, mux)
+
 	// static content serving
 	fs := http.StripPrefix("/filter", http.FileServer(http.Dir("./public/")))
 	configure("/filter/", fs, mux)
@@ -79,90 +154,199 @@ func main() {
 		apip := addrParts[len(addrParts)-1]
 		port, err := strconv.Atoi(apip)
 		if err != nil {
-			log.Fatal(err)
+			applog.Fatal(slog.Default(), "invalid API port", "addr", lAPI.Addr().String(), "err", err)
 		}
 		host := strings.Join(addrParts[:len(addrParts)-1], ":")
 
 		// Forward traffic that pattern matches in http.DefaultServeMux
-		log.Printf("Setting up API fwd at %s:%d", host, port)
+		slog.Info("forwarding API requests", "host", host, "port", port)
 		apif := servemux.NewFilter(mux)
-		apif.SetRequestModifier(mapi.NewForwarder(host, port))
+		fwd := fifo.NewGroup()
+		// let the API server know which client is asking
+		fwd.AddRequestModifier(header.NewForwardedModifier())
+		fwd.AddRequestModifier(mapi.NewForwarder(host, port))
+		apif.SetRequestModifier(fwd)
 		stack.AddRequestModifier(apif)
 	}
 
 	p.SetRequestModifier(stack)
 	p.SetResponseModifier(stack)
 
-	go p.Serve(l)
-	go http.Serve(lAPI, mux)
+	// metrics are only served on the API listener, not through the proxy
+	api := http.NewServeMux()
+	api.Handle("/metrics", metrics.Handler())
+	api.Handle("/", mux)
+
+	// the connections are closed when their policy stops allowing them
+	go p.Serve(filter.Listener(metrics.NewListener(l, "proxy")))
+	go p.Serve(interceptor)
+	if *httpAddr != "" {
+		hl, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to listen", "addr", *httpAddr, "err", err)
+		}
+		slog.Info("starting transparent HTTP listener", "addr", hl.Addr().String())
+		go p.Serve(filter.Listener(metrics.NewListener(transparent.NewListener(hl, dsts), "http")))
+	}
+	tl, err := net.Listen("tcp", *tlsAddr)
+	if err != nil {
+		applog.Fatal(slog.Default(), "unable to listen", "addr", *tlsAddr, "err", err)
+	}
+	mitmLog.Info("starting transparent TLS listener", "addr", tl.Addr().String())
+	// the skipped hosts are told from the ClientHello, before any handshake
+	go interceptor.ServeTransparent(filter.Listener(metrics.NewListener(transparent.NewListener(tl, dsts), "tls")), dsts, filter)
+	if *socksAddr != "" {
+		sl, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to listen", "addr", *socksAddr, "err", err)
+		}
+		slog.Info("starting SOCKS5 listener", "addr", sl.Addr().String())
+		go socks.Serve(filter.Listener(metrics.NewListener(sl, "socks")), func(c net.Conn, host string, port int) {
+			interceptor.ServeStream(c, host, port, filter)
+		})
+	}
+	if *dnsAddr != "" {
+		startDns(dns.NewServer(config, filter, accessLogger))
+	}
+	go http.Serve(lAPI, api)
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt)
 
 	<-sigc
 
-	log.Println("martian: shutting down")
+	slog.Info("shutting down")
+	// the access logs still queued are written first
+	if c, ok := accessLogger.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			slog.Error("unable to close the access logger", "err", err)
+		}
+	}
 	os.Exit(0)
 }
 
-func startMitm(p *martian.Proxy, mux *http.ServeMux) {
+func startMitm(p *martian.Proxy, mux *http.ServeMux, addr net.Addr, up *upstream.Dialer) *intercept.Interceptor {
 	tr := &http.Transport{
 		Dial: (&net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
 		}).Dial,
+		Proxy:                 up.Proxy,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: time.Second,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: *skipTLSVerify,
 		},
+		// the custom dialer disables it otherwise
+		ForceAttemptHTTP2: *http2,
 	}
-	p.SetRoundTripper(tr)
+	// verifying the servers with the configured roots, but the insecure ones
+	p.SetRoundTripper(intercept.HTTP1(logging.NewRoundTripper(up.Transport(tr))))
+	// the tunnels of the skipped hosts
+	p.SetDial(up.Dial)
 
 	var x509c *x509.Certificate
-	var priv interface{}
+	var priv crypto.Signer
 
+	store := ca.NewStore(*dataDir)
 	if *cert == "" || *key == "" {
-		log.Printf("Generating a new ROOT CA for testing purpose. To use persist CA, generate one using openssl and supply -cert and -key")
-		var err error
-		x509c, priv, err = mitm.NewAuthority("martian.proxy", "Martian Authority", 30*24*time.Hour)
+		a, created, err := store.LoadOrGenerate(caName, *organization)
 		if err != nil {
-			log.Fatal(err)
+			applog.Fatal(mitmLog, "unable to load the CA", "data", *dataDir, "err", err)
+		}
+		if created {
+			mitmLog.Warn("generated a new root CA, devices need to trust it", "data", *dataDir, "fingerprint", ca.Fingerprint(a.Cert))
 		}
+		x509c, priv = a.Cert, a.Key
 	} else {
 		tlsc, err := tls.LoadX509KeyPair(*cert, *key)
 		if err != nil {
-			log.Fatal(err)
+			applog.Fatal(mitmLog, "unable to load the CA", "cert", *cert, "key", *key, "err", err)
+		}
+		var ok bool
+		if priv, ok = tlsc.PrivateKey.(crypto.Signer); !ok {
+			applog.Fatal(mitmLog, "unsupported private key", "key", *key)
 		}
-		priv = tlsc.PrivateKey
 
 		x509c, err = x509.ParseCertificate(tlsc.Certificate[0])
 		if err != nil {
-			log.Fatal(err)
+			applog.Fatal(mitmLog, "unable to parse the CA certificate", "cert", *cert, "err", err)
 		}
 	}
 
 	mc, err := mitm.NewConfig(x509c, priv)
 	if err != nil {
-		log.Fatal(err)
+		applog.Fatal(mitmLog, "unable to configure MITM", "err", err)
 	}
 
 	mc.SetValidity(*validity)
 	mc.SetOrganization(*organization)
 	mc.SkipTLSVerify(*skipTLSVerify)
 
+	// martian only answers the CONNECT requests, the interceptor terminates
+	// TLS with the certificates of the cache
 	p.SetMITM(mc)
+	certs, err := ca.NewCertCache(&ca.Authority{Cert: x509c, Key: priv}, filepath.Join(*dataDir, "certs"), *certCacheSize, *validity)
+	if err != nil {
+		applog.Fatal(mitmLog, "unable to load the certificate cache", "err", err)
+	}
 
 	ah := martianhttp.NewAuthorityHandler(x509c)
 	configure("/filter/ca.cer", ah, mux)
+	trusted := func() ([]*x509.Certificate, error) { return []*x509.Certificate{x509c}, nil }
+	if *cert == "" || *key == "" {
+		// include the next CA during a rotation
+		configure("/filter/ca.pem", ca.NewHandler(store, ca.FormatPEM), mux)
+		configure("/filter/ca.mobileconfig", ca.NewHandler(store, ca.FormatMobileConfig), mux)
+		trusted = store.Trusted
+	}
+	// the check is made through the proxy, over TLS
+	sh := ca.NewSetupHandler(trusted, "https://"+*apiHost+"/filter/setup/check")
+	configure("/filter/setup/info", sh, mux)
+	configure("/filter/setup/ca", sh, mux)
+	configure("/filter/setup/check", sh, mux)
+	configure("/filter/setup", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeFile(w, req, "public/setup.html")
+	}), mux)
 
-	tl, err := net.Listen("tcp", *tlsAddr)
-	if err != nil {
-		log.Fatal(err)
+	i := intercept.New(certs, addr)
+	i.SetDialer(up.Dial)
+	if *http2 {
+		i.EnableHTTP2()
 	}
-	log.Printf("Starting transparent TLS listener on %s\n", tl.Addr())
+	return i
+}
 
-	go p.Serve(tls.NewListener(tl, mc.TLS()))
+// logLevels returns the levels of -log-level, or the ones of the deprecated
+// -v when only it is given, telling which.
+func logLevels() (string, bool) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["v"] || set["log-level"] {
+		return *logLevel, false
+	}
+	switch {
+	case *verbosity >= 3:
+		return "debug", true
+	case *verbosity == 2:
+		return "info", true
+	}
+	return "error", true
+}
+
+// startDns serves the DNS queries received on -dns-addr.
+func startDns(s *dns.Server) {
+	pc, err := net.ListenPacket("udp", *dnsAddr)
+	if err != nil {
+		applog.Fatal(slog.Default(), "unable to listen", "addr", *dnsAddr, "err", err)
+	}
+	dl, err := net.Listen("tcp", *dnsAddr)
+	if err != nil {
+		applog.Fatal(slog.Default(), "unable to listen", "addr", *dnsAddr, "err", err)
+	}
+	slog.Info("starting DNS server", "addr", pc.LocalAddr().String())
+	go s.ServeUDP(pc)
+	go s.ServeTCP(metrics.NewListener(dl, "dns"))
 }
 
 // configure installs a configuration handler at path.
@@ -179,9 +363,13 @@ func configure(pattern string, handler http.Handler, mux *http.ServeMux) {
 	mux.Handle(pattern, handler)
 }
 
-func newStack(c *config.Config) (grp *fifo.Group) {
+func newStack(c *config.Config, l logging.AccessLogger, dsts *transparent.Destinations, streams martian.RequestModifier) (grp *fifo.Group) {
 	grp = fifo.NewGroup()
-	logger := logging.NewLogger(c)
+	// the requests of the HTTP/2 streams are secure from here on
+	grp.AddRequestModifier(streams)
+	// the URL is complete from here on
+	grp.AddRequestModifier(transparent.NewHostModifier(dsts))
+	logger := logging.NewLogger(c, l)
 	grp.AddRequestModifier(logger) // required to save a copy of the request
 	grp.AddResponseModifier(logger)
 	grp.AddRequestModifier(header.NewBadFramingModifier())
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"net"
+	"sync"
+)
+
+var (
+	connectionsActive = NewGaugeVec("clarity_connections_active",
+		"Client connections currently open on each listener.", "listener")
+	connectionsTotal = NewCounterVec("clarity_connections_total",
+		"Client connections accepted on each listener.", "listener")
+)
+
+type listener struct {
+	net.Listener
+	name string
+}
+
+// NewListener counts the connections accepted by l under the given name.
+func NewListener(l net.Listener, name string) net.Listener {
+	return &listener{l, name}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	connectionsTotal.Inc(l.name)
+	connectionsActive.Inc(l.name)
+	return &conn{Conn: c, name: l.name}, nil
+}
+
+type conn struct {
+	net.Conn
+	name string
+	once sync.Once
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { connectionsActive.Dec(c.name) })
+	return c.Conn.Close()
+}
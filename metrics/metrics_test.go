@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests.", "decision", "client")
+	c.Inc("allowed", "10.0.0.1")
+	c.Inc("allowed", "10.0.0.1")
+	c.Inc("denied", `a"b`)
+	g := NewGaugeVec("test_active", "Active.", "listener")
+	g.Inc("proxy")
+	g.Inc("proxy")
+	g.Dec("proxy")
+	NewGaugeFunc("test_size", "Size.", func() float64 { return 3 })
+	h := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	Write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{decision="allowed",client="10.0.0.1"} 2` + "\n",
+		`test_requests_total{decision="denied",client="a\"b"} 1` + "\n",
+		`test_active{listener="proxy"} 1` + "\n",
+		"test_size 3\n",
+		`test_latency_seconds_bucket{le="0.1"} 1` + "\n",
+		`test_latency_seconds_bucket{le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{le="+Inf"} 3` + "\n",
+		"test_latency_seconds_sum 5.55\n",
+		"test_latency_seconds_count 3\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "test_active") > strings.Index(out, "test_requests_total") {
+		t.Errorf("Metrics must be sorted by name")
+	}
+}
@@ -0,0 +1,72 @@
+// Package pac generates the proxy auto-config file of the devices, sending
+// everything through the proxy but the skipped hosts and the local networks.
+package pac
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ContentType is the media type of the PAC files.
+const ContentType = "application/x-ns-proxy-autoconfig"
+
+var pacTemplate = template.Must(template.New("pac").Parse(`function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || dnsDomainIs(host, ".local")) {
+		return "DIRECT";
+	}
+	if (/^\d+\.\d+\.\d+\.\d+$/.test(host) && (isInNet(host, "10.0.0.0", "255.0.0.0") ||
+			isInNet(host, "172.16.0.0", "255.240.0.0") || isInNet(host, "192.168.0.0", "255.255.0.0") ||
+			isInNet(host, "127.0.0.0", "255.0.0.0") || isInNet(host, "169.254.0.0", "255.255.0.0"))) {
+		return "DIRECT";
+	}
+	var skipped = [{{range $i, $h := .Skipped}}{{if $i}}, {{end}}{{printf "%q" $h}}{{end}}];
+	for (var i = 0; i < skipped.length; i++) {
+		if (host == skipped[i] || dnsDomainIs(host, "." + skipped[i])) {
+			return "DIRECT";
+		}
+	}
+	return "PROXY {{.Proxy}}";
+}
+`))
+
+type handler struct {
+	skipped []string
+	port    int
+}
+
+// NewHandler serves the PAC file for the proxy listening on port, on the
+// address the devices reach the handler at. Only the skipped hosts, not
+// their paths, can go direct.
+func NewHandler(skipProxy []string, port int) http.Handler {
+	h := &handler{port: port}
+	for _, s := range skipProxy {
+		s = strings.ReplaceAll(s, "*.", "")
+		if strings.Contains(s, "/") {
+			continue
+		}
+		h.skipped = append(h.skipped, strings.ToLower(s))
+	}
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	// the API is reached by its name through the proxy only
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ip, _, err := net.SplitHostPort(addr.String()); err == nil {
+			host = ip
+		}
+	}
+	w.Header().Set("Content-Type", ContentType)
+	pacTemplate.Execute(w, struct {
+		Skipped []string
+		Proxy   string
+	}{h.skipped, net.JoinHostPort(host, strconv.Itoa(h.port))})
+}
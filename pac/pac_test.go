@@ -0,0 +1,23 @@
+package pac
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	h := NewHandler([]string{"*.iCloud.com", "zoom.us", "google.com/chat"}, 8080)
+	req := httptest.NewRequest("GET", "http://192.168.1.2:8181/wpad.dat", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Expected %s, got %s", ContentType, ct)
+	}
+	body := w.Body.String()
+	for _, s := range []string{`var skipped = ["icloud.com", "zoom.us"];`, `return "PROXY 192.168.1.2:8080";`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Expected %s in\n%s", s, body)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/logging"
+)
+
+var apiLog = applog.For("api")
+
+type reportError struct {
+	Result  bool
+	Message string
+}
+
+// NewHandler serves /config/report?date=2006-01-02&period=day|week&format=html|text|json.
+// The date defaults to today.
+func NewHandler(q logging.Querier, gap time.Duration) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		r, err := handle(q, gap, req)
+		if err != nil {
+			apiLog.Warn("report request failed", "query", req.URL.RawQuery, "err", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(reportError{false, err.Error()})
+			return
+		}
+		switch req.URL.Query().Get("format") {
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			r.WriteText(w)
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(r)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			r.WriteHTML(w)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
+
+func handle(q logging.Querier, gap time.Duration, req *http.Request) (*Report, error) {
+	v := req.URL.Query()
+	date := time.Now()
+	if d := v.Get("date"); d != "" {
+		var err error
+		if date, err = time.ParseInLocation("2006-01-02", d, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid date: %s", d)
+		}
+	}
+	from, to, err := Period(date, v.Get("period"))
+	if err != nil {
+		return nil, err
+	}
+	return Generate(q, from, to, gap)
+}
@@ -0,0 +1,111 @@
+package report
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"text/template"
+	"time"
+)
+
+var funcs = map[string]any{
+	"duration": formatDuration,
+	"date":     func(t time.Time) string { return t.Format("2006-01-02") },
+	"policy":   policyName,
+	"bytes":    formatBytes,
+}
+
+const textReport = `Usage report {{date .From}} - {{date .To}}
+{{range .Clients}}
+Client {{.Client}}: active {{duration .ActiveTime}}, {{.Requests}} requests, {{bytes .Bytes}}, {{.Blocked}} blocked, {{.Extensions}} extensions
+  Policies:
+{{- range .Policies}}
+    {{printf "%-40s" (policy .Policy)}} {{printf "%8s" (duration .ActiveTime)}}  blocked {{.Blocked}}, extensions {{.Extensions}}
+{{- end}}
+  Top domains:
+{{- range .TopDomains}}
+    {{printf "%-40s" .Domain}} {{.Requests}}
+{{- end}}
+{{else}}
+No activity.
+{{end}}`
+
+const htmlReport = `<!DOCTYPE html>
+<html>
+
+<head>
+  <title>Usage report {{date .From}} - {{date .To}}</title>
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0-alpha3/dist/css/bootstrap.min.css">
+</head>
+
+<body>
+  <div class="container mt-4">
+    <h2>Usage report {{date .From}} - {{date .To}}</h2>
+    {{range .Clients}}
+    <h4 class="mt-4">{{.Client}}</h4>
+    <p>Active {{duration .ActiveTime}}, {{.Requests}} requests, {{bytes .Bytes}}, {{.Blocked}} blocked, {{.Extensions}} extensions</p>
+    <table class="table table-striped table-sm">
+      <thead>
+        <tr><th>Policy</th><th>Active time</th><th>Requests</th><th>Blocked</th><th>Extensions</th></tr>
+      </thead>
+      <tbody>
+        {{range .Policies}}
+        <tr><td>{{policy .Policy}}</td><td>{{duration .ActiveTime}}</td><td>{{.Requests}}</td><td>{{.Blocked}}</td><td>{{.Extensions}}</td></tr>
+        {{end}}
+      </tbody>
+    </table>
+    <table class="table table-sm">
+      <thead>
+        <tr><th>Top domains</th><th>Requests</th></tr>
+      </thead>
+      <tbody>
+        {{range .TopDomains}}
+        <tr><td>{{.Domain}}</td><td>{{.Requests}}</td></tr>
+        {{end}}
+      </tbody>
+    </table>
+    {{else}}
+    <p>No activity.</p>
+    {{end}}
+  </div>
+</body>
+
+</html>
+`
+
+var (
+	textTemplate = template.Must(template.New("text").Funcs(funcs).Parse(textReport))
+	htmlTemplate = htmltemplate.Must(htmltemplate.New("html").Funcs(funcs).Parse(htmlReport))
+)
+
+func (r *Report) WriteText(w io.Writer) error {
+	return textTemplate.Execute(w, r)
+}
+
+func (r *Report) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, r)
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Minute).String()
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func policyName(p string) string {
+	if p == "" {
+		return "(default)"
+	}
+	return p
+}
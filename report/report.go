@@ -0,0 +1,180 @@
+// Package report summarizes the access log into daily or weekly usage reports.
+package report
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+	"shawnma.com/clarity/logging"
+	"shawnma.com/clarity/util"
+)
+
+const topDomains = 10
+
+type Report struct {
+	From    time.Time
+	To      time.Time
+	Clients []*ClientReport
+}
+
+type ClientReport struct {
+	Client     string
+	ActiveTime time.Duration
+	Requests   int
+	Blocked    int
+	Extensions int
+	// Bytes transferred in both directions
+	Bytes      int64
+	Policies   []*PolicyReport
+	TopDomains []*DomainCount
+}
+
+type PolicyReport struct {
+	Policy     string
+	ActiveTime time.Duration
+	Requests   int
+	Blocked    int
+	Extensions int
+}
+
+type DomainCount struct {
+	Domain   string
+	Requests int
+}
+
+// Period returns the day or the week (starting on Monday) containing date.
+func Period(date time.Time, period string) (from, to time.Time, err error) {
+	from = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	switch period {
+	case "", "day":
+		return from, from.AddDate(0, 0, 1), nil
+	case "week":
+		from = from.AddDate(0, 0, -(int(from.Weekday())+6)%7)
+		return from, from.AddDate(0, 0, 7), nil
+	}
+	return from, from, fmt.Errorf("unknown report period: %s", period)
+}
+
+// Generate builds the report of the logs between from and to. Active time is
+// accounted with the same session gap as the filter uses for policies.
+func Generate(q logging.Querier, from, to time.Time, gap time.Duration) (*Report, error) {
+	logs, err := fetch(q, from, to)
+	if err != nil {
+		return nil, err
+	}
+	// accesses are accounted in time order
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Time.Before(logs[j].Time) })
+
+	type policyAcc struct {
+		r     *PolicyReport
+		times []time.Time
+	}
+	type clientAcc struct {
+		r        *ClientReport
+		times    []time.Time
+		policies map[string]*policyAcc
+		domains  map[string]int
+	}
+	clients := map[string]*clientAcc{}
+	for _, l := range logs {
+		name := client(l.RemoteAddr)
+		c := clients[name]
+		if c == nil {
+			c = &clientAcc{r: &ClientReport{Client: name}, policies: map[string]*policyAcc{}, domains: map[string]int{}}
+			clients[name] = c
+		}
+		p := c.policies[l.Policy]
+		if p == nil {
+			p = &policyAcc{r: &PolicyReport{Policy: l.Policy}}
+			c.policies[l.Policy] = p
+		}
+		switch l.Decision {
+		case logging.DecisionBlocked, logging.DecisionDenied:
+			c.r.Blocked++
+			p.r.Blocked++
+		case logging.DecisionExtended:
+			c.r.Extensions++
+			p.r.Extensions++
+		default:
+			c.r.Requests++
+			c.r.Bytes += l.RequestBytes + l.ResponseBytes
+			p.r.Requests++
+			c.times = append(c.times, l.Time)
+			p.times = append(p.times, l.Time)
+			if d := domain(l.Url); d != "" {
+				c.domains[d]++
+			}
+		}
+	}
+
+	r := &Report{From: from, To: to}
+	for _, c := range clients {
+		c.r.ActiveTime = util.TotalActiveTime(c.times, gap)
+		for _, p := range c.policies {
+			p.r.ActiveTime = util.TotalActiveTime(p.times, gap)
+			c.r.Policies = append(c.r.Policies, p.r)
+		}
+		sort.Slice(c.r.Policies, func(i, j int) bool {
+			a, b := c.r.Policies[i], c.r.Policies[j]
+			return a.ActiveTime > b.ActiveTime || (a.ActiveTime == b.ActiveTime && a.Policy < b.Policy)
+		})
+		for d, n := range c.domains {
+			c.r.TopDomains = append(c.r.TopDomains, &DomainCount{d, n})
+		}
+		sort.Slice(c.r.TopDomains, func(i, j int) bool {
+			a, b := c.r.TopDomains[i], c.r.TopDomains[j]
+			return a.Requests > b.Requests || (a.Requests == b.Requests && a.Domain < b.Domain)
+		})
+		if len(c.r.TopDomains) > topDomains {
+			c.r.TopDomains = c.r.TopDomains[:topDomains]
+		}
+		r.Clients = append(r.Clients, c.r)
+	}
+	sort.Slice(r.Clients, func(i, j int) bool { return r.Clients[i].Client < r.Clients[j].Client })
+	return r, nil
+}
+
+// fetch reads all the logs in the time window page by page.
+func fetch(q logging.Querier, from, to time.Time) ([]*logging.HttpLog, error) {
+	var logs []*logging.HttpLog
+	hq := &logging.HistoryQuery{From: from, To: to, Size: 500}
+	for {
+		p, err := q.Query(hq)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, p.Items...)
+		if p.Next == nil {
+			return logs, nil
+		}
+		hq.Before = p.Next
+	}
+}
+
+func client(remoteAddr string) string {
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return h
+	}
+	return remoteAddr
+}
+
+// domain returns the registrable domain of the host name of u, which groups
+// the subdomains of a site together.
+func domain(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	h := p.Hostname()
+	if net.ParseIP(h) != nil {
+		return h
+	}
+	if d, err := publicsuffix.EffectiveTLDPlusOne(h); err == nil {
+		return d
+	}
+	return h
+}
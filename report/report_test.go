@@ -0,0 +1,114 @@
+package report
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"shawnma.com/clarity/logging"
+)
+
+type fakeQuerier []*logging.HttpLog
+
+func (f fakeQuerier) Query(q *logging.HistoryQuery) (*logging.HistoryPage, error) {
+	p := &logging.HistoryPage{Total: len(f), Size: q.Size}
+	start := 0
+	if q.Before != nil {
+		start = slices.IndexFunc(f, func(l *logging.HttpLog) bool { return l.Id == q.Before.Id }) + 1
+	}
+	for i := start; i < len(f) && i < start+q.Size; i++ {
+		p.Items = append(p.Items, f[i])
+	}
+	if len(p.Items) == q.Size {
+		last := p.Items[len(p.Items)-1]
+		p.Next = &logging.Cursor{Time: last.Time, Id: last.Id}
+	}
+	return p, nil
+}
+
+func (f fakeQuerier) Searches(q *logging.HistoryQuery) (*logging.SearchPage, error) {
+	return &logging.SearchPage{Size: q.Size}, nil
+}
+
+func (f fakeQuerier) Clients() ([]string, error) {
+	return nil, nil
+}
+
+func TestGenerate(t *testing.T) {
+	base := time.Date(2023, 5, 1, 20, 0, 0, 0, time.Local)
+	at := func(m int) time.Time { return base.Add(time.Duration(m) * time.Minute) }
+	logs := fakeQuerier{
+		{Time: at(0), RemoteAddr: "10.1.1.5:5000", Url: "https://www.youtube.com/watch", Policy: "youtube.com"},
+		{Time: at(1), RemoteAddr: "10.1.1.5:5001", Url: "https://i.ytimg.com/vi/1.jpg", Policy: "youtube.com"},
+		{Time: at(2), RemoteAddr: "10.1.1.5:5001", Url: "https://www.youtube.com/watch", Policy: "youtube.com"},
+		// a new session, the gap is not counted
+		{Time: at(30), RemoteAddr: "10.1.1.5:5003", Url: "https://www.youtube.com/watch", Policy: "youtube.com"},
+		{Time: at(31), RemoteAddr: "10.1.1.5:5003", Url: "https://baidu.com/", Policy: "baidu.com", Decision: logging.DecisionDenied},
+		{Time: at(32), RemoteAddr: "10.1.1.5:0", Url: "/config/set?t=10&id=3", Policy: "baidu.com", Decision: logging.DecisionExtended},
+		{Time: at(5), RemoteAddr: "10.1.1.6:5000", Url: "https://doubleclick.net/", Decision: logging.DecisionBlocked},
+	}
+	from, to, _ := Period(base, "day")
+	r, err := Generate(logs, from, to, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(r.Clients))
+	}
+	c := r.Clients[0]
+	if c.Client != "10.1.1.5" || c.ActiveTime != 2*time.Minute || c.Requests != 4 || c.Blocked != 1 || c.Extensions != 1 {
+		t.Errorf("Wrong client report: %+v", c)
+	}
+	if p := c.Policies[0]; p.Policy != "youtube.com" || p.ActiveTime != 2*time.Minute {
+		t.Errorf("Wrong policy report: %+v", p)
+	}
+	if d := c.TopDomains[0]; d.Domain != "youtube.com" || d.Requests != 3 {
+		t.Errorf("Wrong top domain: %+v", d)
+	}
+	if c := r.Clients[1]; c.Blocked != 1 || c.Requests != 0 {
+		t.Errorf("Wrong client report: %+v", c)
+	}
+
+	var text strings.Builder
+	if err := r.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "Client 10.1.1.5: active 2m0s") {
+		t.Errorf("Unexpected text report:\n%s", text.String())
+	}
+	var html strings.Builder
+	if err := r.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	// a Wednesday
+	d := time.Date(2023, 5, 3, 15, 4, 5, 0, time.Local)
+	from, to, _ := Period(d, "week")
+	if from.Weekday() != time.Monday || from.Day() != 1 || to.Sub(from) != 7*24*time.Hour {
+		t.Errorf("Wrong week %s - %s", from, to)
+	}
+	if _, _, err := Period(d, "month"); err == nil {
+		t.Errorf("Expected error for unknown period")
+	}
+}
+
+func TestDomain(t *testing.T) {
+	tests := []struct {
+		url    string
+		domain string
+	}{
+		{"https://www.youtube.com/watch", "youtube.com"},
+		{"https://www.bbc.co.uk/news", "bbc.co.uk"},
+		{"https://user.github.io/", "user.github.io"},
+		{"http://192.168.1.1:8080/", "192.168.1.1"},
+		{"http://localhost/", "localhost"},
+	}
+	for _, tc := range tests {
+		if d := domain(tc.url); d != tc.domain {
+			t.Errorf("%s: expected %s, got %s", tc.url, tc.domain, d)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/logging"
+	"shawnma.com/clarity/report"
+)
+
+// reportCommand writes an HTML and a text usage report for every day or week
+// between -from and -to into -out.
+func reportCommand(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	today := time.Now().Format("2006-01-02")
+	from := fs.String("from", today, "first date to report on, yyyy-mm-dd")
+	to := fs.String("to", today, "last date to report on, yyyy-mm-dd")
+	period := fs.String("period", "day", "report period, day or week")
+	out := fs.String("out", ".", "directory the reports are written to")
+	fs.Parse(args)
+
+	begin, err := time.ParseInLocation("2006-01-02", *from, time.Local)
+	if err != nil {
+		applog.Fatal(slog.Default(), "invalid from date", "from", *from, "err", err)
+	}
+	end, err := time.ParseInLocation("2006-01-02", *to, time.Local)
+	if err != nil {
+		applog.Fatal(slog.Default(), "invalid to date", "to", *to, "err", err)
+	}
+
+	c := config.NewConfig()
+	l, err := logging.NewAccessLogger(c)
+	if err != nil {
+		applog.Fatal(slog.Default(), "unable to create access logger", "err", err)
+	}
+	q, ok := l.(logging.Querier)
+	if !ok {
+		applog.Fatal(slog.Default(), "log provider does not support querying", "provider", c.Logs.Provider)
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		applog.Fatal(slog.Default(), "unable to create the output directory", "out", *out, "err", err)
+	}
+
+	for d := begin; !d.After(end); {
+		pf, pt, err := report.Period(d, *period)
+		if err != nil {
+			applog.Fatal(slog.Default(), "invalid period", "period", *period, "err", err)
+		}
+		r, err := report.Generate(q, pf, pt, c.SessionGap)
+		if err != nil {
+			applog.Fatal(slog.Default(), "unable to generate report", "from", pf.Format("2006-01-02"), "err", err)
+		}
+		name := filepath.Join(*out, fmt.Sprintf("clarity-%s-%s", *period, pf.Format("2006-01-02")))
+		if err := writeReport(name+".html", r.WriteHTML); err != nil {
+			applog.Fatal(slog.Default(), "unable to write report", "file", name+".html", "err", err)
+		}
+		if err := writeReport(name+".txt", r.WriteText); err != nil {
+			applog.Fatal(slog.Default(), "unable to write report", "file", name+".txt", "err", err)
+		}
+		slog.Info("wrote report", "html", name+".html", "text", name+".txt")
+		d = pt
+	}
+}
+
+func writeReport(name string, write func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,144 @@
+// Package socks is a SOCKS5 front-end (RFC 1928) for the apps which don't
+// support HTTP proxies. Only the CONNECT command without authentication is
+// supported.
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"shawnma.com/clarity/applog"
+)
+
+var log = applog.For("socks")
+
+const (
+	version = 5
+
+	methodNoAuth       = 0
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 1
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	replySucceeded           = 0
+	replyCommandNotSupported = 7
+	replyAddressNotSupported = 8
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// errReplied is a failed request the client was told about.
+var errReplied = errors.New("request refused")
+
+// Serve accepts the SOCKS5 connections of l until it fails, passing each one
+// once its request is granted to handle, with the host, a name or an IP, and
+// the port it asks for.
+func Serve(l net.Listener, handle func(c net.Conn, host string, port int)) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			c.SetDeadline(time.Now().Add(handshakeTimeout))
+			host, port, err := handshake(c)
+			if err != nil {
+				if err != errReplied {
+					log.Debug("handshake failed", "client", c.RemoteAddr().String(), "err", err)
+				}
+				c.Close()
+				return
+			}
+			c.SetDeadline(time.Time{})
+			handle(c, host, port)
+		}()
+	}
+}
+
+// handshake negotiates the method and reads the request, which is granted
+// before reaching the destination, as most of the connections are
+// intercepted.
+func handshake(rw io.ReadWriter) (string, int, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		return "", 0, err
+	}
+	if b[0] != version {
+		return "", 0, fmt.Errorf("unsupported version %d", b[0])
+	}
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", 0, err
+	}
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodNoAuth {
+			method = methodNoAuth
+		}
+	}
+	if _, err := rw.Write([]byte{version, method}); err != nil {
+		return "", 0, err
+	}
+	if method == methodNoAcceptable {
+		return "", 0, errReplied
+	}
+
+	// VER CMD RSV ATYP
+	if _, err := io.ReadFull(rw, b[:4]); err != nil {
+		return "", 0, err
+	}
+	if b[0] != version {
+		return "", 0, fmt.Errorf("unsupported version %d", b[0])
+	}
+	var host string
+	switch b[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if b[3] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case atypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(rw, l[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(rw, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		reply(rw, replyAddressNotSupported)
+		return "", 0, errReplied
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(rw, port[:]); err != nil {
+		return "", 0, err
+	}
+	if b[1] != cmdConnect {
+		reply(rw, replyCommandNotSupported)
+		return "", 0, errReplied
+	}
+	if err := reply(rw, replySucceeded); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// reply answers the request, without a bound address.
+func reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{version, code, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,44 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+)
+
+type rw struct {
+	*bytes.Reader
+	out bytes.Buffer
+}
+
+func (r *rw) Write(b []byte) (int, error) {
+	return r.out.Write(b)
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    []byte
+		host  string
+		port  int
+		reply []byte
+	}{
+		{"domain", []byte{5, 1, 0, 5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187},
+			"example.com", 443, []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"ipv4", []byte{5, 2, 2, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0, 80},
+			"192.0.2.1", 80, []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"ipv6", append(append([]byte{5, 1, 0, 5, 1, 0, 4}, make([]byte, 15)...), 1, 0, 80),
+			"::1", 80, []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"auth only", []byte{5, 1, 2}, "", 0, []byte{5, 0xff}},
+		{"bind", []byte{5, 1, 0, 5, 2, 0, 1, 192, 0, 2, 1, 0, 80}, "", 0, []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tc := range tests {
+		c := &rw{Reader: bytes.NewReader(tc.in)}
+		host, port, err := handshake(c)
+		if host != tc.host || port != tc.port || (err == nil) != (tc.host != "") {
+			t.Errorf("%s: expected %s:%d, got %s:%d, %v", tc.name, tc.host, tc.port, host, port, err)
+		}
+		if !bytes.Equal(c.out.Bytes(), tc.reply) {
+			t.Errorf("%s: expected reply %v, got %v", tc.name, tc.reply, c.out.Bytes())
+		}
+	}
+}
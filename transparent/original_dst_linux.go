@@ -0,0 +1,53 @@
+package transparent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// OriginalDst returns the destination of a connection before netfilter
+// redirected it to the proxy.
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local, ok := c.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			var info *syscall.IPv6MTUInfo
+			info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if serr == nil {
+				// the port is in network byte order in memory
+				var port [2]byte
+				binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+				addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+			}
+			return
+		}
+		var mreq *syscall.IPv6Mreq
+		// sockaddr_in fits in the 16 bytes of the multicast request
+		mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if serr == nil {
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, serr
+}
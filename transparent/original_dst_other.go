@@ -0,0 +1,13 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDst is only supported on Linux.
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("original destination is only supported on linux")
+}
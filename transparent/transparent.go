@@ -0,0 +1,107 @@
+// Package transparent supports the listeners receiving connections redirected
+// by a router, e.g. with iptables REDIRECT, rather than sent to the proxy.
+package transparent
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/google/martian/v3"
+)
+
+// Destinations are the original destinations of the open connections, by
+// the address of their client.
+type Destinations struct {
+	mu sync.Mutex
+	m  map[string]*net.TCPAddr
+}
+
+func NewDestinations() *Destinations {
+	return &Destinations{m: map[string]*net.TCPAddr{}}
+}
+
+// Lookup returns the original destination of the connection of the client.
+func (d *Destinations) Lookup(remoteAddr string) *net.TCPAddr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m[remoteAddr]
+}
+
+func (d *Destinations) set(remoteAddr string, dst *net.TCPAddr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dst == nil {
+		delete(d.m, remoteAddr)
+	} else {
+		d.m[remoteAddr] = dst
+	}
+}
+
+type listener struct {
+	net.Listener
+	dsts *Destinations
+}
+
+// NewListener records the original destination of the connections accepted
+// by l, which must be a TCP listener.
+func NewListener(l net.Listener, dsts *Destinations) net.Listener {
+	return &listener{l, dsts}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	dst, err := OriginalDst(c)
+	// connections made to the listener itself were not redirected
+	if err != nil || dst.String() == c.LocalAddr().String() {
+		return c, nil
+	}
+	l.dsts.set(c.RemoteAddr().String(), dst)
+	return &conn{Conn: c, dsts: l.dsts}, nil
+}
+
+type conn struct {
+	net.Conn
+	dsts *Destinations
+	once sync.Once
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { c.dsts.set(c.RemoteAddr().String(), nil) })
+	return c.Conn.Close()
+}
+
+type hostModifier struct {
+	dsts *Destinations
+}
+
+// NewHostModifier returns a modifier completing the requests without a Host
+// header, from HTTP/1.0 clients, with the original destination of their
+// connection.
+func NewHostModifier(dsts *Destinations) martian.RequestModifier {
+	return &hostModifier{dsts}
+}
+
+func (m *hostModifier) ModifyRequest(req *http.Request) error {
+	if req.URL.Host != "" {
+		return nil
+	}
+	dst := m.dsts.Lookup(req.RemoteAddr)
+	if dst == nil {
+		return nil
+	}
+	host := dst.IP.String()
+	if dst.IP.To4() == nil {
+		host = "[" + host + "]"
+	}
+	if (req.URL.Scheme == "http" && dst.Port != 80) || (req.URL.Scheme == "https" && dst.Port != 443) {
+		host = net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port))
+	}
+	req.URL.Host = host
+	req.Host = host
+	return nil
+}
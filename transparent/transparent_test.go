@@ -0,0 +1,58 @@
+package transparent
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHostModifier(t *testing.T) {
+	d := NewDestinations()
+	d.set("10.0.0.1:1234", &net.TCPAddr{IP: net.ParseIP("93.184.216.34"), Port: 80})
+	d.set("10.0.0.1:1235", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8080})
+	m := NewHostModifier(d)
+	tests := []struct {
+		remote string
+		host   string
+		want   string
+	}{
+		{"10.0.0.1:1234", "", "93.184.216.34"},
+		{"10.0.0.1:1235", "", "[2001:db8::1]:8080"},
+		{"10.0.0.1:1234", "example.com", "example.com"},
+		{"10.0.0.2:1234", "", ""},
+	}
+	for _, tc := range tests {
+		req, _ := http.NewRequest("GET", "http:///index.html", nil)
+		req.URL.Host = tc.host
+		req.RemoteAddr = tc.remote
+		m.ModifyRequest(req)
+		if req.URL.Host != tc.want {
+			t.Errorf("%s %s: expected %s, got %s", tc.remote, tc.host, tc.want, req.URL.Host)
+		}
+	}
+}
+
+func TestListenerDirect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d := NewDestinations()
+	tl := NewListener(l, d)
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	c, err := tl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// not redirected, so there is no original destination
+	if dst := d.Lookup(c.RemoteAddr().String()); dst != nil {
+		t.Errorf("Unexpected destination %s", dst)
+	}
+}
@@ -0,0 +1,248 @@
+// Package upstream reaches the servers directly or through other proxies,
+// HTTP, HTTPS or SOCKS5, chosen by host.
+package upstream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"shawnma.com/clarity/applog"
+	"shawnma.com/clarity/config"
+	"shawnma.com/clarity/util"
+)
+
+var log = applog.For("upstream")
+
+const dialTimeout = 30 * time.Second
+
+// Dialer connects to the hosts through the proxy of the first rule matching
+// them, or the default one. A nil proxy means directly.
+type Dialer struct {
+	direct *net.Dialer
+	rules  []rule
+	proxy  *url.URL
+	// servers not verified
+	insecure *hosts
+	// trusted on top of the system roots, nil if none
+	roots *x509.CertPool
+}
+
+type rule struct {
+	hosts *hosts
+	proxy *url.URL
+}
+
+// hosts matches domains, including their subdomains, IPs and networks.
+type hosts struct {
+	domains util.UrlMatch[bool]
+	nets    []*net.IPNet
+}
+
+func parseHosts(hs []string) (*hosts, error) {
+	h := &hosts{}
+	for _, s := range hs {
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", s, err)
+			}
+			h.nets = append(h.nets, n)
+		} else if ip := net.ParseIP(s); ip != nil {
+			h.nets = append(h.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			h.domains.Add(s, true)
+		}
+	}
+	return h, nil
+}
+
+func (h *hosts) matches(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range h.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return h.domains.Match(host, "/")
+}
+
+// New returns the dialer of the configuration, failing on invalid proxies or
+// hosts.
+func New(c config.UpstreamConfig) (*Dialer, error) {
+	d := &Dialer{direct: &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}}
+	var err error
+	if d.proxy, err = parseProxy(c.Proxy); err != nil {
+		return nil, err
+	}
+	for _, rc := range c.Rules {
+		r := rule{}
+		if r.proxy, err = parseProxy(rc.Proxy); err != nil {
+			return nil, err
+		}
+		if r.hosts, err = parseHosts(rc.Hosts); err != nil {
+			return nil, err
+		}
+		d.rules = append(d.rules, r)
+	}
+	if d.insecure, err = parseHosts(c.Insecure); err != nil {
+		return nil, err
+	}
+	if c.RootCAs != "" {
+		if d.roots, err = loadRoots(c.RootCAs); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// loadRoots returns the system roots along with the ones of the PEM file.
+func loadRoots(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return roots, nil
+}
+
+// parseProxy parses the URL of a proxy, nil for "direct" or empty.
+func parseProxy(s string) (*url.URL, error) {
+	if s == "" || s == "direct" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %w", s, err)
+	}
+	port := ""
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	case "socks5":
+		port = "1080"
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy %q, it should be http, https or socks5", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// ProxyFor is the proxy the host is reached through, nil if directly.
+func (d *Dialer) ProxyFor(host string) *url.URL {
+	for i := range d.rules {
+		if d.rules[i].hosts.matches(host) {
+			return d.rules[i].proxy
+		}
+	}
+	return d.proxy
+}
+
+// Proxy tells the transport of the proxy of the request, as http.Transport
+// Proxy does.
+func (d *Dialer) Proxy(req *http.Request) (*url.URL, error) {
+	return d.ProxyFor(req.URL.Hostname()), nil
+}
+
+// Dial connects to the address through the proxy of its host.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	u := d.ProxyFor(host)
+	if u == nil {
+		return d.direct.Dial(network, addr)
+	}
+	log.Debug("dialing through proxy", "addr", addr, "proxy", u.Redacted())
+	if u.Scheme == "socks5" {
+		var auth *proxy.Auth
+		if u.User != nil {
+			p, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: p}
+		}
+		s, err := proxy.SOCKS5("tcp", u.Host, auth, d.direct)
+		if err != nil {
+			return nil, err
+		}
+		return s.Dial(network, addr)
+	}
+	return d.connect(u, addr)
+}
+
+// connect opens a tunnel to the address through the HTTP proxy.
+func (d *Dialer) connect(u *url.URL, addr string) (net.Conn, error) {
+	c, err := d.direct.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	if u.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: u.Hostname(), RootCAs: d.roots})
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		p, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+p)))
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("upstream proxy %s refused %s: %s", u.Host, addr, res.Status)
+	}
+	c.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{c, br}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn reads what was buffered along the response of the proxy.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Transport returns the round tripper sending the requests with tr, which
+// verifies the servers with the configured roots, but the insecure ones. A
+// server failing the verification gets a warning page rather than an error,
+// for the client to tell why it can't be reached.
+func (d *Dialer) Transport(tr *http.Transport) http.RoundTripper {
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	if d.roots != nil {
+		tr.TLSClientConfig.RootCAs = d.roots
+	}
+	insecure := tr.Clone()
+	insecure.TLSClientConfig.InsecureSkipVerify = true
+	return &transport{d, tr, insecure}
+}
+
+type transport struct {
+	d        *Dialer
+	secure   *http.Transport
+	insecure *http.Transport
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if t.d.insecure.matches(host) {
+		return t.insecure.RoundTrip(req)
+	}
+	res, err := t.secure.RoundTrip(req)
+	var ve *tls.CertificateVerificationError
+	if err != nil && errors.As(err, &ve) {
+		log.Warn("unable to verify the server", "host", host, "err", ve.Err)
+		return warning(req, ve), nil
+	}
+	return res, err
+}
+
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unverified server</title></head>
+<body>
+<h1>The server of {{.Host}} couldn't be verified</h1>
+<p>Its certificate isn't trusted, so the connection may not be private and
+was not made.</p>
+<pre>{{.Err}}</pre>
+{{if .Issuer}}<p>Certificate issued to {{.Subject}} by {{.Issuer}}.</p>{{end}}
+<p>If it's a device of the network, such as a router or a NAS, it may be
+added to <code>upstream.insecure</code> in the config of the proxy, or its
+CA to <code>upstream.root-cas</code>.</p>
+</body>
+</html>
+`))
+
+// warning is the response of the proxy when the server failed verification.
+func warning(req *http.Request, ve *tls.CertificateVerificationError) *http.Response {
+	data := struct {
+		Host, Err, Subject, Issuer string
+	}{Host: req.URL.Hostname(), Err: ve.Err.Error()}
+	if len(ve.UnverifiedCertificates) > 0 {
+		c := ve.UnverifiedCertificates[0]
+		data.Subject, data.Issuer = c.Subject.String(), c.Issuer.String()
+	}
+	var b bytes.Buffer
+	warningPage.Execute(&b, data)
+	return &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Status:     strconv.Itoa(http.StatusBadGateway) + " " + http.StatusText(http.StatusBadGateway),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  {"text/html; charset=utf-8"},
+			"Cache-Control": {"no-store"},
+		},
+		ContentLength: int64(b.Len()),
+		Body:          io.NopCloser(&b),
+		Request:       req,
+	}
+}
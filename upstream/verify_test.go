@@ -0,0 +1,58 @@
+package upstream
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"shawnma.com/clarity/config"
+)
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(roots, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		c      config.UpstreamConfig
+		status int
+		body   string
+	}{
+		{"unverified", config.UpstreamConfig{}, http.StatusBadGateway, "couldn't be verified"},
+		{"insecure", config.UpstreamConfig{Insecure: []string{"127.0.0.0/8"}}, http.StatusOK, "hello"},
+		{"insecure elsewhere", config.UpstreamConfig{Insecure: []string{"nas.lan"}}, http.StatusBadGateway, "127.0.0.1"},
+		{"custom roots", config.UpstreamConfig{RootCAs: roots}, http.StatusOK, "hello"},
+	}
+	for _, tc := range tests {
+		d, err := New(tc.c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		res, err := d.Transport(&http.Transport{}).RoundTrip(req)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status || !strings.Contains(string(body), tc.body) {
+			t.Errorf("%s: expected %d with %q, got %d: %s", tc.name, tc.status, tc.body, res.StatusCode, body)
+		}
+	}
+
+	if _, err := New(config.UpstreamConfig{RootCAs: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("Expected an error for missing roots")
+	}
+}
@@ -0,0 +1,32 @@
+package util
+
+import "time"
+
+// DefaultSessionGap is how long a client may stay silent before its next
+// access starts a new browsing session.
+const DefaultSessionGap = 2 * time.Minute
+
+// ActiveTime returns how much active time an access at now adds to a session
+// whose previous access was at last. Accesses within gap of each other belong
+// to the same session and the time in between counts as active; a longer gap
+// starts a new session which contributes nothing until the next access.
+func ActiveTime(last, now time.Time, gap time.Duration) time.Duration {
+	if last.IsZero() {
+		return 0
+	}
+	d := now.Sub(last)
+	if d <= 0 || d > gap {
+		return 0
+	}
+	return d
+}
+
+// TotalActiveTime sums the active time of accesses sorted by time.
+func TotalActiveTime(times []time.Time, gap time.Duration) (total time.Duration) {
+	var last time.Time
+	for _, t := range times {
+		total += ActiveTime(last, t, gap)
+		last = t
+	}
+	return total
+}
@@ -1,7 +1,7 @@
 package util
 
 import (
-	"log"
+	"log/slog"
 	"strings"
 )
 
@@ -16,7 +16,7 @@ type UrlMatch[T comparable] struct {
 func (u *UrlMatch[T]) Add(url string, t T) {
 	h, p := splitUrl(url)
 	h = reverseHost(h)
-	log.Printf("Adding %s %s", h, p)
+	slog.Debug("adding url match", "host", h, "path", p)
 	u.paths.Put(h, true)
 	u.t.Put(h+p, t)
 }